@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"log"
+	"os"
 
 	"go.uber.org/fx"
 
@@ -17,7 +19,36 @@ func provideConfig() (*shared.Config, error) {
 // NOTE: Just added metrics parameter - fx provides it automatically!
 // NEW: Now returns Database interface and selects implementation based on config
 // This is the ONLY place we need to change to switch database implementations!
-func provideDatabase(lc fx.Lifecycle, logger *shared.Logger, config *shared.Config, metrics *shared.Metrics) shared.Database {
+// Middleware from config.json (logging, metrics, retry, circuit breaker) is assembled here too
+// With tenancy enabled, the same stack is built once per tenant behind a router
+func provideDatabase(lc fx.Lifecycle, logger *shared.Logger, config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
+	var db shared.Database
+	if config.Tenancy.Enabled {
+		logger.Log("APP", "Using multi-tenant database")
+		db = shared.NewTenantDatabase(func(config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
+			return buildDatabase(logger, config, metrics)
+		}, logger, config, metrics)
+	} else {
+		var err error
+		if db, err = buildDatabase(logger, config, metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			return db.Initialize(ctx)
+		},
+		OnStop: func(ctx context.Context) error {
+			return db.Close(ctx)
+		},
+	})
+
+	return db, nil
+}
+
+// buildDatabase assembles the backend and its wrappers from config
+func buildDatabase(logger *shared.Logger, config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
 	// FX automatically selects the right database based on config!
 	var db shared.Database
 	
@@ -25,21 +56,46 @@ func provideDatabase(lc fx.Lifecycle, logger *shared.Logger, config *shared.Conf
 	case "persistent":
 		logger.Log("APP", "Using persistent database")
 		db = shared.NewPersistentDatabase(logger, config, metrics)
+	case "replicated":
+		logger.Log("APP", "Using replicated database")
+		replicated, err := shared.NewReplicatedDatabase(logger, config, metrics)
+		if err != nil {
+			return nil, err
+		}
+		db = replicated
+	case "sharded":
+		logger.Log("APP", "Using sharded database")
+		sharded, err := shared.NewShardedDatabase(logger, config, metrics)
+		if err != nil {
+			return nil, err
+		}
+		db = sharded
 	default:
 		logger.Log("APP", "Using in-memory database")
 		db = shared.NewInMemoryDatabase(logger, config, metrics)
 	}
 
-	lc.Append(fx.Hook{
-		OnStart: func(ctx context.Context) error {
-			return db.Initialize()
-		},
-		OnStop: func(ctx context.Context) error {
-			return db.Close()
-		},
-	})
+	// Cap concurrent queries at max_connections, whatever the backend
+	db = shared.NewPooledDatabase(db, logger, config, metrics)
 
-	return db
+	// Observability and resilience for free - any backend gets the same chain
+	middlewares, err := shared.NewMiddlewares(logger, config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	db = shared.Chain(db, middlewares...)
+
+	// Caching composes the same way - cache hits never take a connection
+	if config.App.Features["cache_enabled"] {
+		db = shared.NewCachingDatabase(db, logger, config, metrics)
+	}
+
+	// Auditing goes outermost so its before-reads hit the cache
+	if config.App.Features["audit_log"] {
+		db = shared.NewAuditingDatabase(db, logger, config, metrics)
+	}
+
+	return db, nil
 }
 
 // StartServer registers lifecycle hooks to start/stop the HTTP server
@@ -68,6 +124,27 @@ func StartServer(lc fx.Lifecycle, server *shared.Server, logger *shared.Logger,
 	})
 }
 
+// runCommand runs an admin subcommand such as export or import
+// The same providers build the database; fx just never starts the server.
+func runCommand(args []string) error {
+	var db shared.Database
+	app := fx.New(
+		fx.NopLogger,
+		fx.Provide(provideConfig, provideDatabase, shared.NewLogger, shared.NewMetrics),
+		fx.Populate(&db),
+	)
+
+	ctx := context.Background()
+	if err := app.Start(ctx); err != nil {
+		return err
+	}
+	err := shared.RunCommand(ctx, db, args, os.Stdout)
+	if stopErr := app.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
 func formatBool(b bool) string {
 	if b {
 		return "yes"
@@ -85,6 +162,14 @@ func main() {
 	// 5. ADDING METRICS: Just one line! No constructor changes needed!
 	// 6. DATABASE SWITCHING: Just update the provider function - zero impact on other code!
 
+	// Admin subcommands (export/import) share the wiring but skip the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal("Command failed:", err)
+		}
+		return
+	}
+
 	app := fx.New(
 		fx.NopLogger,
 
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -76,7 +77,7 @@ func TestUserServiceFX(t *testing.T) {
 
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
-		assert.Contains(t, rec.Body.String(), "Test User 1")
+		assert.Equal(t, "User: Test User 1\n", rec.Body.String())
 		assert.Equal(t, "test1", mockDB.LastRequestedID)
 	})
 
@@ -92,6 +93,22 @@ func TestUserServiceFX(t *testing.T) {
 		assert.Contains(t, rec.Body.String(), "User not found")
 	})
 
+	t.Run("lookup exceeds deadline", func(t *testing.T) {
+		mockDB.Delay = 50 * time.Millisecond
+		defer func() { mockDB.Delay = 0 }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, "/user?id=test1", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		err := userService.GetUserHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	})
+
 	// FX handles cleanup automatically!
 }
 
@@ -106,7 +123,7 @@ func TestDatabaseSwappingFX(t *testing.T) {
 			name: "mock database",
 			provideDB: func() shared.Database {
 				mock := shared.NewMockDatabase()
-				mock.Users["1"] = "Mock User"
+				mock.Users["1"] = shared.NewUser("1", "Mock User")
 				return mock
 			},
 			expectedUser: "Mock User",
@@ -115,7 +132,7 @@ func TestDatabaseSwappingFX(t *testing.T) {
 			name: "custom mock database",
 			provideDB: func() shared.Database {
 				mock := shared.NewMockDatabase()
-				mock.Users["1"] = "Custom Test User"
+				mock.Users["1"] = shared.NewUser("1", "Custom Test User")
 				return mock
 			},
 			expectedUser: "Custom Test User",
@@ -198,10 +215,10 @@ func TestIntegrationFX(t *testing.T) {
 			
 			lc.Append(fx.Hook{
 				OnStart: func(ctx context.Context) error {
-					return mockDB.Initialize()
+					return mockDB.Initialize(ctx)
 				},
 				OnStop: func(ctx context.Context) error {
-					return mockDB.Close()
+					return mockDB.Close(ctx)
 				},
 			})
 			
@@ -247,11 +264,11 @@ func TestLifecycleManagementFX(t *testing.T) {
 			lc.Append(fx.Hook{
 				OnStart: func(ctx context.Context) error {
 					t.Log("FX: Starting database")
-					return mockDB.Initialize()
+					return mockDB.Initialize(ctx)
 				},
 				OnStop: func(ctx context.Context) error {
 					t.Log("FX: Stopping database")
-					return mockDB.Close()
+					return mockDB.Close(ctx)
 				},
 			})
 			return mockDB
@@ -327,7 +344,7 @@ func TestMetricsInjectionFX(t *testing.T) {
 	statsAfter := metrics.GetStats()
 	assert.Contains(t, statsAfter, "User Lookups: 1")
 	// Note: Mock database doesn't call metrics.RecordDBQuery() - that's good for isolation!
-	// In production, the real database implementations call it
+	// In production, the metrics middleware from provideDatabase records it
 	
 	// Verify mock was called
 	assert.Equal(t, 1, mockDB.GetUserCalls)
@@ -335,3 +352,65 @@ func TestMetricsInjectionFX(t *testing.T) {
 	// This shows how fx automatically injects metrics everywhere needed
 	// Without fx, we'd have to manually pass metrics to every component
 }
+
+// TestCachingDatabaseFX shows decorators composing with the mock just like real backends
+func TestCachingDatabaseFX(t *testing.T) {
+	var db shared.Database
+	var metrics *shared.Metrics
+	mockDB := shared.NewMockDatabase()
+
+	app := fxtest.New(
+		t,
+		fx.Provide(
+			func() (*shared.Config, error) {
+				return &shared.Config{
+					Database: shared.DatabaseConfig{CacheSize: 10, CachePolicy: shared.CachePolicyLRU},
+					App: shared.AppConfig{
+						Environment: "test",
+						Features:    map[string]bool{"metrics_enabled": true},
+					},
+				}, nil
+			},
+			shared.NewLogger,
+			shared.NewMetrics,
+			// Wrap the mock in the caching decorator - one line
+			func(logger *shared.Logger, config *shared.Config, metrics *shared.Metrics) shared.Database {
+				return shared.NewCachingDatabase(mockDB, logger, config, metrics)
+			},
+		),
+		fx.Populate(&db, &metrics),
+	)
+
+	app.RequireStart()
+	defer app.RequireStop()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		user, err := db.GetUser(ctx, "test1")
+		require.NoError(t, err)
+		assert.Equal(t, "Test User 1", user.Name)
+	}
+	assert.Equal(t, 1, mockDB.GetUserCalls)
+	assert.Contains(t, metrics.GetStats(), "Hits: 2")
+
+	// Writes invalidate the cached entry
+	_, err := db.UpdateUser(ctx, &shared.User{ID: "test1", Name: "Renamed"})
+	require.NoError(t, err)
+
+	user, err := db.GetUser(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", user.Name)
+	assert.Equal(t, 2, mockDB.GetUserCalls)
+
+	// Batch lookups only fetch what the cache is missing
+	users, err := db.GetUsers(ctx, []string{"test1", "test2", "missing"})
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "Test User 2", users["test2"].Name)
+	assert.Equal(t, 1, mockDB.GetUsersCalls)
+
+	users, err = db.GetUsers(ctx, []string{"test1", "test2"})
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, 1, mockDB.GetUsersCalls)
+}
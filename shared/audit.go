@@ -0,0 +1,372 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// auditFileName is the audit log created next to the data file
+	auditFileName = "demo_users.audit.ndjson"
+	// systemActor is recorded for writes that don't come from a request
+	systemActor = "system"
+	// anonymousActor is recorded for requests that didn't authenticate
+	anonymousActor = "anonymous"
+	// adminActor is recorded for requests authenticated with the admin token
+	adminActor = "admin"
+	// auditUpdateAttempts bounds how often an unconditional update is retried
+	// when another writer gets in between reading the before state and writing
+	auditUpdateAttempts = 5
+)
+
+// ErrAuditDisabled is returned for history when no audit log is kept
+var ErrAuditDisabled = errors.New("audit log not enabled")
+
+// actorKey carries the identity responsible for a write in a context
+type actorKey struct{}
+
+// WithActor returns a context whose writes are attributed to actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by WithActor, or "" if there is none
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// requestOriginKey carries where a request came from in a context
+type requestOriginKey struct{}
+
+// requestOrigin identifies the HTTP request behind a write
+type requestOrigin struct {
+	claimedActor string // X-Actor header, as sent by the caller
+	requestID    string
+	remoteAddr   string
+}
+
+// withRequestOrigin returns a context whose writes are logged with origin
+func withRequestOrigin(ctx context.Context, origin requestOrigin) context.Context {
+	return context.WithValue(ctx, requestOriginKey{}, origin)
+}
+
+// AuditEntry records one successful write to a user
+// Actor is an identity the server verified; ClaimedActor is whatever the
+// caller put in the X-Actor header and is kept only as a hint.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"`
+	ClaimedActor string    `json:"claimed_actor,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	Action       string    `json:"action"` // create, update or delete
+	UserID       string    `json:"user_id"`
+	Before       *User     `json:"before,omitempty"`
+	After        *User     `json:"after,omitempty"`
+}
+
+// auditHistory is implemented by databases that can list a user's audit trail
+type auditHistory interface {
+	History(ctx context.Context, id string) ([]AuditEntry, error)
+}
+
+// AuditingDatabase records who changed which user, and how, in an
+// append-only NDJSON log next to the data file
+// Updates read the current record first and replace exactly that version,
+// so the logged before state is always the one the write replaced.
+type AuditingDatabase struct {
+	db      Database
+	logger  *Logger
+	config  *DatabaseConfig
+	metrics *Metrics
+	path    string
+	cipher  *fileCipher // encrypts each entry when configured
+
+	mu   sync.Mutex // serializes appends and history reads
+	file *os.File
+}
+
+// NewAuditingDatabase wraps db with an audit log in the data directory
+func NewAuditingDatabase(db Database, logger *Logger, config *Config, metrics *Metrics) *AuditingDatabase {
+	return &AuditingDatabase{
+		db:      db,
+		logger:  logger,
+		config:  &config.Database,
+		metrics: metrics,
+		path:    filepath.Join(config.Database.storageDir(), auditFileName),
+	}
+}
+
+// Initialize initializes the wrapped database and opens the audit log
+func (a *AuditingDatabase) Initialize(ctx context.Context) (err error) {
+	if err := a.db.Initialize(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Release what the wrapped database holds, such as its file lock
+			a.db.Close(ctx)
+		}
+	}()
+	cipher, err := newFileCipher(&a.config.Encryption)
+	if err != nil {
+		return err
+	}
+	a.cipher = cipher
+	if a.config.ReadOnly {
+		// Nothing can be written, but existing history stays readable
+		return nil
+	}
+
+	perm, err := a.config.FilePerm()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	if err := a.reseal(perm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	a.mu.Lock()
+	a.file = file
+	a.mu.Unlock()
+	a.logger.Log("DATABASE", fmt.Sprintf("Audit log enabled: %s", a.path))
+	return nil
+}
+
+// Close closes the audit log and the wrapped database
+func (a *AuditingDatabase) Close(ctx context.Context) error {
+	a.mu.Lock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.mu.Unlock()
+	return a.db.Close(ctx)
+}
+
+// GetUser passes through to the wrapped database
+func (a *AuditingDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	return a.db.GetUser(ctx, id)
+}
+
+// GetUsers passes through to the wrapped database
+func (a *AuditingDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	return a.db.GetUsers(ctx, ids)
+}
+
+// ListUsers passes through to the wrapped database
+func (a *AuditingDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	return a.db.ListUsers(ctx)
+}
+
+// QueryUsers passes through to the wrapped database
+func (a *AuditingDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	return a.db.QueryUsers(ctx, query)
+}
+
+// CreateUser creates a user and records it
+func (a *AuditingDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	created, err := a.db.CreateUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	a.record(ctx, EventCreate, created.ID, nil, created)
+	return created, nil
+}
+
+// UpdateUser updates a user and records its state before and after
+func (a *AuditingDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	for attempt := 1; ; attempt++ {
+		// A lagging replica would hand back a version that can never match
+		before, err := a.db.GetUser(withPrimaryRead(ctx), user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		update := user.Clone()
+		if user.Version == 0 {
+			// Pin the update to the version just read
+			update.Version = before.Version
+			update.CreatedAt = before.CreatedAt
+		} else if err := checkVersion(before, user); err != nil {
+			// What was read is not what the update would replace, so it
+			// can't be logged as the before state
+			return nil, err
+		}
+		updated, err := a.db.UpdateUser(ctx, update)
+		if errors.Is(err, ErrVersionConflict) && user.Version == 0 && attempt < auditUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.record(ctx, EventUpdate, updated.ID, before, updated)
+		return updated, nil
+	}
+}
+
+// DeleteUser deletes a user and records its last state
+func (a *AuditingDatabase) DeleteUser(ctx context.Context, id string) error {
+	before, err := a.db.GetUser(withPrimaryRead(ctx), id)
+	if err != nil {
+		return err
+	}
+	if err := a.db.DeleteUser(ctx, id); err != nil {
+		return err
+	}
+	a.record(ctx, EventDelete, id, before, nil)
+	return nil
+}
+
+// Watch passes through to the wrapped database
+func (a *AuditingDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return a.db.Watch(ctx, after)
+}
+
+// record appends an entry for a write that already succeeded
+// A failed append can't undo the write, so it is logged and counted instead.
+func (a *AuditingDatabase) record(ctx context.Context, action, id string, before, after *User) {
+	actor := ActorFromContext(ctx)
+	if actor == "" {
+		actor = systemActor
+	}
+	origin, _ := ctx.Value(requestOriginKey{}).(requestOrigin)
+	entry := AuditEntry{
+		Time:         time.Now().UTC(),
+		Actor:        actor,
+		ClaimedActor: origin.claimedActor,
+		RequestID:    origin.requestID,
+		RemoteAddr:   origin.remoteAddr,
+		Action:       action,
+		UserID:       id,
+		Before:       before,
+		After:        after,
+	}
+
+	err := a.append(entry)
+	if err != nil {
+		a.logger.Log("DATABASE", fmt.Sprintf("Error writing audit entry for %s of user %s: %v", action, id, err))
+	}
+	if a.metrics != nil {
+		a.metrics.RecordAuditEntry(err != nil)
+	}
+}
+
+// append writes one entry as a line and syncs it to disk
+func (a *AuditingDatabase) append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if data, err = a.cipher.seal(sealAudit, data); err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errors.New("audit log is not open")
+	}
+	if _, err := a.file.Write(data); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// reseal rewrites the audit log with the current key if any entry is in
+// plaintext being migrated or sealed with a previous key
+func (a *AuditingDatabase) reseal(perm os.FileMode) error {
+	if a.cipher == nil {
+		return nil
+	}
+	data, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	stale := false
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		plaintext, rekey, err := a.cipher.open(sealAudit, line)
+		if err != nil {
+			return fmt.Errorf("audit log %s line %d %w", a.path, i+1, err)
+		}
+		if rekey {
+			if lines[i], err = a.cipher.seal(sealAudit, plaintext); err != nil {
+				return err
+			}
+			stale = true
+		}
+	}
+	if !stale {
+		return nil
+	}
+	if err := writeFileAtomic(a.path, append(bytes.Join(lines, []byte("\n")), '\n'), perm); err != nil {
+		return fmt.Errorf("failed to re-encrypt audit log: %w", err)
+	}
+	a.logger.Log("DATABASE", fmt.Sprintf("Re-encrypted audit log %s with key %s", a.path, a.cipher.current.id))
+	return nil
+}
+
+// History returns the audit entries for a user, oldest first
+// Entries for deleted users are kept, so their history stays available.
+func (a *AuditingDatabase) History(ctx context.Context, id string) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		data, _, err := a.cipher.open(sealAudit, scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("audit log %s line %d %w", a.path, line, err)
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("corrupt audit log %s at line %d: %w", a.path, line, err)
+		}
+		if entry.UserID == id {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
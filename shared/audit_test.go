@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditTrail(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	inner := NewCachingDatabase(NewInMemoryDatabase(logger, config, metrics), logger, config, metrics)
+	db := NewAuditingDatabase(inner, logger, config, metrics)
+
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	server := NewServer(NewUserService(db, logger, config, metrics), logger, config, metrics)
+	do := func(method, target, body, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if actor != "" {
+			req.Header.Set(HeaderActor, actor)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/users", `{"id":"9","name":"Nina"}`, "alice").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/users/9", `{"name":"Nora"}`, "").Code)
+	_, err := db.UpdateUser(WithActor(ctx, "batch-job"), &User{ID: "9", Name: "Nell"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/users/9", "", "bob").Code)
+
+	// History survives the delete
+	rec := do(http.MethodGet, "/users/9/history", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []AuditEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	require.Len(t, entries, 4)
+
+	// X-Actor is only a claim; the request itself is identified alongside
+	assert.Equal(t, EventCreate, entries[0].Action)
+	assert.Equal(t, anonymousActor, entries[0].Actor)
+	assert.Equal(t, "alice", entries[0].ClaimedActor)
+	assert.NotEmpty(t, entries[0].RequestID)
+	assert.Equal(t, "192.0.2.1:1234", entries[0].RemoteAddr)
+	assert.Nil(t, entries[0].Before)
+	assert.Equal(t, "Nina", entries[0].After.Name)
+
+	assert.Equal(t, EventUpdate, entries[1].Action)
+	assert.Equal(t, anonymousActor, entries[1].Actor)
+	assert.Empty(t, entries[1].ClaimedActor)
+	assert.NotEqual(t, entries[0].RequestID, entries[1].RequestID)
+	assert.Equal(t, "Nina", entries[1].Before.Name)
+	assert.Equal(t, "Nora", entries[1].After.Name)
+
+	assert.Equal(t, "batch-job", entries[2].Actor)
+	assert.Empty(t, entries[2].RequestID)
+	assert.Equal(t, entries[1].After.Version, entries[2].Before.Version)
+
+	assert.Equal(t, EventDelete, entries[3].Action)
+	assert.Equal(t, anonymousActor, entries[3].Actor)
+	assert.Equal(t, "bob", entries[3].ClaimedActor)
+	assert.Equal(t, "Nell", entries[3].Before.Name)
+	assert.Nil(t, entries[3].After)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/users/1/history", "", "").Code)
+}
+
+func TestAuditInitializeFailure(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.Encryption = EncryptionConfig{KeyFile: writeTestKey(t, config.Database.DataDir, "a.key")}
+	logger := NewLogger(config)
+	ctx := context.Background()
+
+	// The audit log can't be opened after the data file already is
+	path := filepath.Join(config.Database.DataDir, auditFileName)
+	require.NoError(t, os.WriteFile(path, []byte(`{"actor":"mallory"}`+"\n"), 0600))
+	db := NewAuditingDatabase(NewPersistentDatabase(logger, config, nil), logger, config, nil)
+	require.ErrorIs(t, db.Initialize(ctx), ErrTampered)
+
+	// The data file was let go of on the way out
+	inner := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, inner.Initialize(ctx))
+	require.NoError(t, inner.Close(ctx))
+}
+
+// staleReadDatabase serves reads of one user from an old copy
+type staleReadDatabase struct {
+	Database
+	stale *User
+}
+
+func (d *staleReadDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	if id == d.stale.ID {
+		return d.stale.Clone(), nil
+	}
+	return d.Database.GetUser(ctx, id)
+}
+
+func TestAuditPinnedUpdate(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	ctx := context.Background()
+
+	inner := NewInMemoryDatabase(logger, config, nil)
+	require.NoError(t, inner.Initialize(ctx))
+	old, err := inner.GetUser(ctx, "1")
+	require.NoError(t, err)
+	current, err := inner.UpdateUser(ctx, &User{ID: "1", Name: "Alicia"})
+	require.NoError(t, err)
+
+	// The before state read is older than the version the caller replaces
+	db := NewAuditingDatabase(&staleReadDatabase{Database: inner, stale: old}, logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+	_, err = db.UpdateUser(ctx, &User{ID: "1", Name: "Alison", Version: current.Version})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	entries, err := db.History(ctx, "1")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,384 @@
+package shared
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache policies selectable through DatabaseConfig.CachePolicy
+const (
+	CachePolicyLRU = "lru"
+	CachePolicyLFU = "lfu"
+	CachePolicyTTL = "ttl"
+)
+
+// defaultCacheTTL applies to the TTL policy when cache_ttl_seconds is unset
+const defaultCacheTTL = 5 * time.Minute
+
+// Cache stores recently used users in front of a database
+// Implementations are safe for concurrent use and never exceed their capacity
+type Cache interface {
+	Get(key string) (*User, bool)
+	Set(key string, user *User)
+	Delete(key string)
+	Clear()
+	Len() int
+}
+
+// NewCache builds the cache selected by config.Database.CachePolicy
+// Unknown policies fall back to LRU (LoadConfig rejects them up front).
+// Evictions are reported through metrics
+func NewCache(config *Config, metrics *Metrics) Cache {
+	capacity := config.Database.CacheSize
+	onEvict := func() {
+		if metrics != nil {
+			metrics.RecordCacheEviction()
+		}
+	}
+
+	switch config.Database.cachePolicy() {
+	case CachePolicyLFU:
+		return newLFUCache(capacity, onEvict)
+	case CachePolicyTTL:
+		ttl := defaultCacheTTL
+		if config.Database.CacheTTL > 0 {
+			ttl = time.Duration(config.Database.CacheTTL) * time.Second
+		}
+		return newTTLCache(capacity, ttl, onEvict)
+	default:
+		return newLRUCache(capacity, onEvict)
+	}
+}
+
+// cachePolicy returns the configured cache policy, defaulting to LRU
+func (c *DatabaseConfig) cachePolicy() string {
+	if c.CachePolicy == "" {
+		return CachePolicyLRU
+	}
+	return c.CachePolicy
+}
+
+// validCachePolicy reports whether policy names a known cache implementation
+func validCachePolicy(policy string) bool {
+	switch policy {
+	case CachePolicyLRU, CachePolicyLFU, CachePolicyTTL:
+		return true
+	}
+	return false
+}
+
+// lruCache evicts the least recently used entry when full
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front = most recently used
+	items    map[string]*list.Element
+	onEvict  func()
+}
+
+type lruEntry struct {
+	key  string
+	user *User
+}
+
+func newLRUCache(capacity int, onEvict func()) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+func (c *lruCache) Get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).user, true
+}
+
+func (c *lruCache) Set(key string, user *User) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruEntry).user = user
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+		c.onEvict()
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, user: user})
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// lfuCache evicts the least frequently used entry when full, breaking ties by recency
+// Entries are kept in per-frequency lists so every operation is O(1)
+type lfuCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	freqs    map[int]*list.List // frequency -> entries, front = most recent
+	minFreq  int
+	onEvict  func()
+}
+
+type lfuEntry struct {
+	key  string
+	user *User
+	freq int
+}
+
+func newLFUCache(capacity int, onEvict func()) *lfuCache {
+	return &lfuCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		freqs:    make(map[int]*list.List),
+		onEvict:  onEvict,
+	}
+}
+
+// touch moves an entry to the next frequency bucket; caller holds c.mu
+func (c *lfuCache) touch(elem *list.Element) *list.Element {
+	entry := elem.Value.(*lfuEntry)
+	bucket := c.freqs[entry.freq]
+	bucket.Remove(elem)
+	if bucket.Len() == 0 {
+		delete(c.freqs, entry.freq)
+		if c.minFreq == entry.freq {
+			c.minFreq++
+		}
+	}
+	entry.freq++
+	return c.bucket(entry.freq).PushFront(entry)
+}
+
+// bucket returns the list for freq, creating it if needed; caller holds c.mu
+func (c *lfuCache) bucket(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+func (c *lfuCache) Get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	elem = c.touch(elem)
+	c.items[key] = elem
+	return elem.Value.(*lfuEntry).user, true
+}
+
+func (c *lfuCache) Set(key string, user *User) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lfuEntry).user = user
+		c.items[key] = c.touch(elem)
+		return
+	}
+	if len(c.items) >= c.capacity {
+		bucket := c.freqs[c.minFreq]
+		victim := bucket.Back()
+		bucket.Remove(victim)
+		if bucket.Len() == 0 {
+			delete(c.freqs, c.minFreq)
+		}
+		delete(c.items, victim.Value.(*lfuEntry).key)
+		c.onEvict()
+	}
+	c.minFreq = 1
+	c.items[key] = c.bucket(1).PushFront(&lfuEntry{key: key, user: user, freq: 1})
+}
+
+func (c *lfuCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*lfuEntry)
+	bucket := c.freqs[entry.freq]
+	bucket.Remove(elem)
+	if bucket.Len() == 0 {
+		delete(c.freqs, entry.freq)
+	}
+	delete(c.items, key)
+
+	// Recompute minFreq if its bucket just emptied
+	if len(c.items) > 0 && c.freqs[c.minFreq] == nil {
+		c.minFreq = 0
+		for freq := range c.freqs {
+			if c.minFreq == 0 || freq < c.minFreq {
+				c.minFreq = freq
+			}
+		}
+	}
+}
+
+func (c *lfuCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.freqs = make(map[int]*list.List)
+	c.minFreq = 0
+}
+
+func (c *lfuCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// ttlCache expires entries a fixed time after they were written
+// When full, the entry closest to expiry is evicted first
+type ttlCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front = expires soonest
+	items    map[string]*list.Element
+	onEvict  func()
+	now      func() time.Time
+}
+
+type ttlEntry struct {
+	key     string
+	user    *User
+	expires time.Time
+}
+
+func newTTLCache(capacity int, ttl time.Duration, onEvict func()) *ttlCache {
+	return &ttlCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+		now:      time.Now,
+	}
+}
+
+// removeExpired drops every entry past its deadline; caller holds c.mu
+func (c *ttlCache) removeExpired() {
+	now := c.now()
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		entry := elem.Value.(*ttlEntry)
+		if now.Before(entry.expires) {
+			return
+		}
+		c.order.Remove(elem)
+		delete(c.items, entry.key)
+		c.onEvict()
+	}
+}
+
+func (c *ttlCache) Get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*ttlEntry).user, true
+}
+
+func (c *ttlCache) Set(key string, user *User) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+	if c.order.Len() >= c.capacity {
+		soonest := c.order.Front()
+		c.order.Remove(soonest)
+		delete(c.items, soonest.Value.(*ttlEntry).key)
+		c.onEvict()
+	}
+	// Every entry shares the same TTL, so appending keeps the list sorted by expiry
+	c.items[key] = c.order.PushBack(&ttlEntry{key: key, user: user, expires: c.now().Add(c.ttl)})
+}
+
+func (c *ttlCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *ttlCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *ttlCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+	return c.order.Len()
+}
@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		touch   []string // keys read after a, b and c are cached
+		evicted string
+	}{
+		// Least recently used goes first, so reading a saves it
+		{name: "lru", policy: CachePolicyLRU, touch: []string{"a"}, evicted: "b"},
+		// Least frequently used goes first; a tie goes to the older entry
+		{name: "lfu", policy: CachePolicyLFU, touch: []string{"a", "a", "c"}, evicted: "b"},
+		{name: "lfu tie", policy: CachePolicyLFU, touch: []string{"b", "c"}, evicted: "a"},
+		// Soonest to expire goes first, however often it was read
+		{name: "ttl", policy: CachePolicyTTL, touch: []string{"a", "a"}, evicted: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConcurrencyTestConfig(t)
+			config.Database.CacheSize = 3
+			config.Database.CachePolicy = tt.policy
+			metrics := NewMetrics(config)
+			cache := NewCache(config, metrics)
+
+			for _, key := range []string{"a", "b", "c"} {
+				cache.Set(key, NewUser(key, key))
+			}
+			for _, key := range tt.touch {
+				_, ok := cache.Get(key)
+				require.True(t, ok, key)
+			}
+			assert.Zero(t, metrics.cacheEvictions.Load())
+
+			cache.Set("d", NewUser("d", "d"))
+			assert.Equal(t, 3, cache.Len())
+			assert.Equal(t, int64(1), metrics.cacheEvictions.Load())
+			for _, key := range []string{"a", "b", "c", "d"} {
+				_, ok := cache.Get(key)
+				assert.Equal(t, key != tt.evicted, ok, key)
+			}
+
+			// Replacing a cached key never evicts another
+			cache.Set("d", NewUser("d", "D"))
+			assert.Equal(t, int64(1), metrics.cacheEvictions.Load())
+		})
+	}
+}
+
+func TestCacheTTLExpiry(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.CachePolicy = CachePolicyTTL
+	config.Database.CacheTTL = 60
+	metrics := NewMetrics(config)
+	cache := NewCache(config, metrics).(*ttlCache)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", NewUser("a", "a"))
+	now = now.Add(30 * time.Second)
+	cache.Set("b", NewUser("b", "b"))
+
+	now = now.Add(30 * time.Second)
+	_, ok := cache.Get("a")
+	assert.False(t, ok)
+	_, ok = cache.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), metrics.cacheEvictions.Load())
+
+	now = now.Add(time.Minute)
+	assert.Zero(t, cache.Len())
+	assert.Equal(t, int64(2), metrics.cacheEvictions.Load())
+}
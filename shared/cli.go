@@ -0,0 +1,113 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrUnknownCommand is returned by RunCommand for an unrecognized subcommand
+var ErrUnknownCommand = errors.New("unknown command")
+
+// commandUsage lists the subcommands RunCommand understands
+const commandUsage = `commands:
+  export [-format json|ndjson|csv] [-tenant id] <file|->
+  import [-format json|ndjson|csv] [-tenant id] [-conflict skip|overwrite|fail] [-dry-run] <file|->`
+
+// RunCommand runs a one-off admin subcommand against an initialized database
+// Both binaries call it when started with arguments, so the dataset can be
+// moved between environments with the same wiring the server uses. Log
+// output goes to stdout, so exports should name a file rather than "-".
+func RunCommand(ctx context.Context, db Database, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w\n%s", ErrUnknownCommand, commandUsage)
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	format := flags.String("format", "", "dataset format (default: from the file extension)")
+	tenant := flags.String("tenant", "", "tenant whose users to move (default: tenancy.default)")
+
+	switch args[0] {
+	case "export":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		path, err := commandPath(flags)
+		if err != nil {
+			return err
+		}
+		if *format == "" {
+			*format = FormatFromPath(path)
+		}
+		if *tenant != "" {
+			ctx = WithTenant(ctx, *tenant)
+		}
+
+		out := stdout
+		if path != "-" {
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		count, err := ExportUsers(ctx, db, out, *format)
+		if err != nil {
+			return err
+		}
+		if path != "-" {
+			fmt.Fprintf(stdout, "Exported %d users to %s\n", count, path)
+		}
+		return nil
+
+	case "import":
+		conflict := flags.String("conflict", ConflictSkip, "what to do with existing users: skip, overwrite or fail")
+		dryRun := flags.Bool("dry-run", false, "validate and report without writing")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		path, err := commandPath(flags)
+		if err != nil {
+			return err
+		}
+		if *format == "" {
+			*format = FormatFromPath(path)
+		}
+		if *tenant != "" {
+			ctx = WithTenant(ctx, *tenant)
+		}
+
+		var in io.Reader = os.Stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		result, err := ImportUsers(ctx, db, in, ImportOptions{Format: *format, Conflict: *conflict, DryRun: *dryRun})
+		if result != nil {
+			report, _ := json.MarshalIndent(result, "", "  ")
+			fmt.Fprintf(stdout, "%s\n", report)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("%w %q\n%s", ErrUnknownCommand, args[0], commandUsage)
+	}
+}
+
+// commandPath returns the single file argument of a subcommand
+func commandPath(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("%s needs exactly one file argument (use - for standard streams)\n%s", flags.Name(), commandUsage)
+	}
+	return flags.Arg(0), nil
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 )
 
 // Config holds application-wide configuration
 type Config struct {
 	Server   ServerConfig   `json:"server"`
 	Database DatabaseConfig `json:"database"`
+	Tenancy  TenancyConfig  `json:"tenancy"`
 	App      AppConfig      `json:"app"`
 }
 
@@ -25,13 +27,175 @@ type DatabaseConfig struct {
 	MaxConnections int    `json:"max_connections"`
 	Timeout        int    `json:"timeout_seconds"`
 	CacheSize      int    `json:"cache_size"`
+	CachePolicy    string `json:"cache_policy"` // lru, lfu or ttl
+	CacheTTL       int    `json:"cache_ttl_seconds"`
+
+	// Signs pagination cursors; a random per-process key is used when empty
+	CursorSecret string `json:"cursor_secret"`
+
+	// Seed data loaded when a store starts empty (JSON, NDJSON or CSV files).
+	// Environment fixtures are added for the matching app environment; with
+	// neither, backends seed built-in demo users unless start_empty is set.
+	Fixtures            []string            `json:"fixtures"`
+	EnvironmentFixtures map[string][]string `json:"environment_fixtures"`
+	StartEmpty          bool                `json:"start_empty"`
+
+	// How long a query waits for a free connection before giving up
+	PoolWaitTimeout int `json:"pool_wait_timeout_ms"`
+
+	// Connection slots shared by every tenant's pool, so max_connections
+	// caps the whole deployment; set by TenantDatabase
+	pool connectionSlots
+
+	// Persistent backend storage options
+	DataDir            string `json:"data_dir"`
+	FileMode           string `json:"file_mode"` // Octal, e.g. "0600"
+	ReadOnly           bool   `json:"read_only"`
+	CompactionInterval int    `json:"compaction_interval_seconds"` // Autosave interval
+	AutosaveMutations  int    `json:"autosave_mutations"`          // Unsaved changes that trigger an early autosave
+
+	// Reloading the data file when it is edited by hand; 0 disables polling
+	EditCheckInterval  int    `json:"edit_check_interval_ms"`
+	EditConflictPolicy string `json:"edit_conflict_policy"` // "disk" (default), "memory" or "newest"
+
+	// Encryption of the data file, journal and audit log
+	Encryption EncryptionConfig `json:"encryption"`
+
+	// Middleware wrapped around the backend, outermost first:
+	// "logging", "metrics", "retry", "circuit_breaker"
+	Middleware     []string             `json:"middleware"`
+	Retry          RetryConfig          `json:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+
+	// Members of the "replicated" backend
+	Replication ReplicationConfig `json:"replication"`
+
+	// Shards of the "sharded" backend
+	Sharding ShardingConfig `json:"sharding"`
+}
+
+// ReplicationConfig describes the members of a replicated database
+type ReplicationConfig struct {
+	Primary             string   `json:"primary"`  // Backend type, e.g. "persistent"
+	Replicas            []string `json:"replicas"` // Backend type of each replica
+	HealthCheckInterval int      `json:"health_check_interval_ms"`
+	FailoverThreshold   int      `json:"failover_threshold"` // Failed checks before promoting a replica
+}
+
+// RetryConfig controls the retry middleware
+// Only reads are retried unless RetryWrites is set: a write that failed
+// after the backend applied it would otherwise be applied twice.
+type RetryConfig struct {
+	MaxAttempts int  `json:"max_attempts"`
+	BaseDelay   int  `json:"base_delay_ms"`
+	MaxDelay    int  `json:"max_delay_ms"`
+	RetryWrites bool `json:"retry_writes"` // Also retry creates, updates and deletes
+}
+
+// CircuitBreakerConfig controls the circuit breaker middleware
+type CircuitBreakerConfig struct {
+	FailureThreshold int `json:"failure_threshold"`
+	OpenSeconds      int `json:"open_seconds"`
+}
+
+// EncryptionConfig names the AES-256 key that encrypts persistent files
+// Keys are 32 random bytes, base64-encoded, e.g. `openssl rand -base64 32`.
+// To rotate, configure the new key and move the old one to PreviousKeys;
+// the data file is re-encrypted with the new key on the next start.
+// Once a key is configured, plaintext files are rejected as tampered unless
+// MigratePlaintext is set for the one start that encrypts existing data.
+type EncryptionConfig struct {
+	KeyEnv           string   `json:"key_env"`           // Environment variable holding the key
+	KeyFile          string   `json:"key_file"`          // File holding the key
+	PreviousKeys     []string `json:"previous_keys"`     // Key files, or "env:NAME", still accepted for reading
+	MigratePlaintext bool     `json:"migrate_plaintext"` // Accept and encrypt plaintext files; unset afterwards
+}
+
+// ShardingConfig describes the shards of a sharded database
+type ShardingConfig struct {
+	Shards       []string `json:"shards"` // Backend type of each shard; append to add a shard
+	VirtualNodes int      `json:"virtual_nodes"`
+}
+
+// TenancyConfig hosts several customer datasets in one deployment
+// Requests name their tenant with a header or a subdomain of Domain. Each
+// tenant gets its own database, cache and metrics, with files under
+// DataDir/tenants/<id>.
+type TenancyConfig struct {
+	Enabled bool     `json:"enabled"`
+	Header  string   `json:"header"`  // Request header naming the tenant; default X-Tenant-ID
+	Domain  string   `json:"domain"`  // Base domain for <tenant>.<domain> hosts; empty disables subdomains
+	Tenants []string `json:"tenants"` // Tenants served, all opened at startup; required when enabled
+	Default string   `json:"default"` // Tenant for requests that name none; empty rejects them
+}
+
+// defaultFileMode is used when file_mode is not configured
+const defaultFileMode os.FileMode = 0600
+
+// FilePerm parses FileMode into permission bits
+func (c *DatabaseConfig) FilePerm() (os.FileMode, error) {
+	if c.FileMode == "" {
+		return defaultFileMode, nil
+	}
+	mode, err := strconv.ParseUint(c.FileMode, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, fmt.Errorf("invalid file_mode %q: expected octal permissions like \"0600\"", c.FileMode)
+	}
+	if mode&0600 != 0600 {
+		return 0, fmt.Errorf("invalid file_mode %q: owner needs read and write access", c.FileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// redacted returns a copy safe to show to unauthenticated clients
+func (c Config) redacted() Config {
+	if c.Database.CursorSecret != "" {
+		c.Database.CursorSecret = "REDACTED"
+	}
+	return c
+}
+
+// storageDir is where data files live: DataDir, or the system temp directory
+func (c *DatabaseConfig) storageDir() string {
+	if c.DataDir == "" {
+		return os.TempDir()
+	}
+	return c.DataDir
 }
 
 // AppConfig holds application-specific configuration
 type AppConfig struct {
-	Environment string `json:"environment"`
-	LogLevel    string `json:"log_level"`
+	Environment string          `json:"environment"`
+	LogLevel    string          `json:"log_level"`
 	Features    map[string]bool `json:"features"`
+
+	// The admin API needs a bearer token, read from this environment variable
+	// (default ADMIN_TOKEN); it stays off while the variable is unset
+	AdminTokenEnv  string `json:"admin_token_env"`
+	MaxImportBytes int64  `json:"max_import_bytes"` // Largest dataset accepted by /admin/import
+}
+
+// Defaults for the admin API settings
+const (
+	defaultAdminTokenEnv        = "ADMIN_TOKEN"
+	defaultMaxImportBytes int64 = 64 << 20
+)
+
+// adminToken returns the token the admin API requires, or "" if none is set
+func (c *AppConfig) adminToken() string {
+	name := c.AdminTokenEnv
+	if name == "" {
+		name = defaultAdminTokenEnv
+	}
+	return os.Getenv(name)
+}
+
+// maxImportBytes returns MaxImportBytes, or the default when unset
+func (c *AppConfig) maxImportBytes() int64 {
+	if c.MaxImportBytes <= 0 {
+		return defaultMaxImportBytes
+	}
+	return c.MaxImportBytes
 }
 
 // LoadConfig loads configuration from file or returns defaults
@@ -47,6 +211,36 @@ func LoadConfig(path string) (*Config, error) {
 			MaxConnections: 10,
 			Timeout:        30,
 			CacheSize:      100,
+			CachePolicy:    CachePolicyLRU,
+			CacheTTL:       300,
+
+			PoolWaitTimeout: 1000,
+
+			DataDir:            "data",
+			FileMode:           "0600",
+			CompactionInterval: 60,
+			AutosaveMutations:  1000,
+
+			Middleware: []string{MiddlewareMetrics, MiddlewareLogging, MiddlewareRetry, MiddlewareCircuitBreaker},
+			Retry: RetryConfig{
+				MaxAttempts: 3,
+				BaseDelay:   50,
+				MaxDelay:    1000,
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				FailureThreshold: 5,
+				OpenSeconds:      30,
+			},
+			Replication: ReplicationConfig{
+				Primary:             "persistent",
+				Replicas:            []string{"inmemory", "inmemory"},
+				HealthCheckInterval: 5000,
+				FailoverThreshold:   3,
+			},
+			Sharding: ShardingConfig{
+				Shards:       []string{"persistent", "persistent", "persistent"},
+				VirtualNodes: 100,
+			},
 		},
 		App: AppConfig{
 			Environment: "development",
@@ -82,5 +276,15 @@ func LoadConfig(path string) (*Config, error) {
 		}
 	}
 
+	if !validCachePolicy(config.Database.cachePolicy()) {
+		return nil, fmt.Errorf("invalid cache_policy %q: expected lru, lfu or ttl", config.Database.CachePolicy)
+	}
+	if !validEditPolicy(config.Database.editPolicy()) {
+		return nil, fmt.Errorf("invalid edit_conflict_policy %q: expected disk, memory or newest", config.Database.EditConflictPolicy)
+	}
+	if err := config.Tenancy.validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
-}
\ No newline at end of file
+}
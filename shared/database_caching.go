@@ -0,0 +1,221 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CachingDatabase adds a read-through cache in front of any Database
+// Reads are served from the cache when possible and every write invalidates
+// the affected entry, so backends no longer need their own caching. Writes
+// that bypass it, such as a reload of an externally edited data file, reach
+// the cache through the wrapped database's change feed.
+type CachingDatabase struct {
+	db      Database
+	logger  *Logger
+	config  *DatabaseConfig
+	metrics *Metrics
+	cache   Cache
+
+	// mu orders cache fills against invalidations; generation changes on
+	// every write so a lookup that raced with a write never caches stale data
+	mu         sync.Mutex
+	generation uint64
+
+	stopFollow context.CancelFunc
+	followDone chan struct{}
+}
+
+// NewCachingDatabase wraps db with the cache selected in config
+func NewCachingDatabase(db Database, logger *Logger, config *Config, metrics *Metrics) *CachingDatabase {
+	return &CachingDatabase{
+		db:      db,
+		logger:  logger,
+		config:  &config.Database,
+		metrics: metrics,
+		cache:   NewCache(config, metrics),
+	}
+}
+
+// Initialize initializes the wrapped database
+func (c *CachingDatabase) Initialize(ctx context.Context) error {
+	c.logger.Log("DATABASE", fmt.Sprintf("Cache enabled with size: %d, policy: %s",
+		c.config.CacheSize, c.config.cachePolicy()))
+	if err := c.db.Initialize(ctx); err != nil {
+		return err
+	}
+	c.startFollowing()
+	return nil
+}
+
+// Close stops following changes and closes the wrapped database
+func (c *CachingDatabase) Close(ctx context.Context) error {
+	if c.stopFollow != nil {
+		c.stopFollow()
+		<-c.followDone
+		c.stopFollow = nil
+	}
+	return c.db.Close(ctx)
+}
+
+// GetUser returns a cached user or loads it from the wrapped database
+func (c *CachingDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	if cached, ok := c.cache.Get(id); ok {
+		c.logger.Log("DATABASE", fmt.Sprintf("Cache hit for user ID: %s", id))
+		if c.metrics != nil {
+			c.metrics.RecordCacheHit()
+		}
+		return cached.Clone(), nil
+	}
+	if c.metrics != nil {
+		c.metrics.RecordCacheMiss()
+	}
+
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	// Fill only from data that already reflects every invalidated write
+	user, err := c.db.GetUser(withPrimaryRead(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.cache.Set(id, user.Clone())
+		c.logger.Log("DATABASE", fmt.Sprintf("Cached user %s", id))
+	}
+	c.mu.Unlock()
+	return user, nil
+}
+
+// GetUsers serves cached users and fetches only the misses in one batch
+func (c *CachingDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	users := make(map[string]*User, len(ids))
+	var missing []string
+	for _, id := range ids {
+		if cached, ok := c.cache.Get(id); ok {
+			users[id] = cached.Clone()
+			continue
+		}
+		missing = append(missing, id)
+	}
+	if c.metrics != nil {
+		for range len(ids) - len(missing) {
+			c.metrics.RecordCacheHit()
+		}
+		for range missing {
+			c.metrics.RecordCacheMiss()
+		}
+	}
+	if len(missing) == 0 {
+		c.logger.Log("DATABASE", fmt.Sprintf("Cache hit for all %d users", len(ids)))
+		return users, nil
+	}
+
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	fetched, err := c.db.GetUsers(withPrimaryRead(ctx), missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	fill := c.generation == generation
+	for id, user := range fetched {
+		if fill {
+			c.cache.Set(id, user.Clone())
+		}
+		users[id] = user
+	}
+	c.mu.Unlock()
+	c.logger.Log("DATABASE", fmt.Sprintf("Cache hit for %d of %d users", len(ids)-len(missing), len(ids)))
+	return users, nil
+}
+
+// ListUsers always reads through to the wrapped database
+func (c *CachingDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	return c.db.ListUsers(ctx)
+}
+
+// QueryUsers always reads through to the wrapped database
+func (c *CachingDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	return c.db.QueryUsers(ctx, query)
+}
+
+// CreateUser creates a user in the wrapped database
+func (c *CachingDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	defer c.invalidate(user.ID)
+	return c.db.CreateUser(ctx, user)
+}
+
+// UpdateUser updates a user and drops any cached copy
+func (c *CachingDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	defer c.invalidate(user.ID)
+	return c.db.UpdateUser(ctx, user)
+}
+
+// DeleteUser deletes a user and drops any cached copy
+func (c *CachingDatabase) DeleteUser(ctx context.Context, id string) error {
+	defer c.invalidate(id)
+	return c.db.DeleteUser(ctx, id)
+}
+
+// Watch streams change events from the wrapped database
+func (c *CachingDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return c.db.Watch(ctx, after)
+}
+
+// startFollowing invalidates cached users as change events arrive
+// A watcher that fell behind resumes where it left off; if those events are
+// gone the whole cache is dropped, since any entry may be stale.
+func (c *CachingDatabase) startFollowing() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopFollow = cancel
+	c.followDone = make(chan struct{})
+
+	go func() {
+		defer close(c.followDone)
+		var last uint64
+		for ctx.Err() == nil {
+			events, err := c.db.Watch(ctx, last)
+			if errors.Is(err, ErrEventsExpired) {
+				c.clear()
+				last = 0
+				continue
+			}
+			if err != nil {
+				c.logger.Log("DATABASE", fmt.Sprintf("Cache stopped following changes: %v", err))
+				return
+			}
+			for event := range events {
+				c.invalidate(event.ID)
+				last = event.Seq
+			}
+		}
+	}()
+}
+
+// clear drops every cached user
+func (c *CachingDatabase) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.cache.Clear()
+	c.logger.Log("DATABASE", "Cache cleared after missing change events")
+}
+
+// invalidate removes id from the cache after a write, successful or not
+func (c *CachingDatabase) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.cache.Delete(id)
+}
@@ -0,0 +1,210 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newConcurrencyTestConfig keeps persistent data in a per-test directory and
+// uses a tiny cache so evictions happen constantly
+func newConcurrencyTestConfig(t *testing.T) *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			DataDir:   t.TempDir(),
+			CacheSize: 4,
+		},
+		App: AppConfig{
+			Environment: "test",
+			LogLevel:    "error",
+			Features: map[string]bool{
+				"cache_enabled":   true,
+				"rate_limiting":   true,
+				"metrics_enabled": true,
+			},
+		},
+	}
+}
+
+// TestConcurrentDatabaseAccess hammers both backends, behind the caching
+// decorator, from many goroutines. Run with -race to catch unguarded state.
+func TestConcurrentDatabaseAccess(t *testing.T) {
+	backends := []struct {
+		name string
+		new  func(*Logger, *Config, *Metrics) Database
+	}{
+		{"inmemory", func(l *Logger, c *Config, m *Metrics) Database { return NewInMemoryDatabase(l, c, m) }},
+		{"persistent", func(l *Logger, c *Config, m *Metrics) Database { return NewPersistentDatabase(l, c, m) }},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			config := newConcurrencyTestConfig(t)
+			logger := NewLogger(config)
+			metrics := NewMetrics(config)
+			db := NewCachingDatabase(backend.new(logger, config, metrics), logger, config, metrics)
+
+			ctx := context.Background()
+			require.NoError(t, db.Initialize(ctx))
+			defer db.Close(ctx)
+
+			const workers = 16
+			const usersPerWorker = 4
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < usersPerWorker; i++ {
+						id := fmt.Sprintf("w%d-%d", w, i)
+						if _, err := db.CreateUser(ctx, NewUser(id, "created")); err != nil {
+							errs <- err
+							return
+						}
+						if _, err := db.UpdateUser(ctx, &User{ID: id, Name: "updated"}); err != nil {
+							errs <- err
+							return
+						}
+						// Everyone reads the same seeded user to contend on one shard and cache entry
+						if _, err := db.GetUser(ctx, "1"); err != nil {
+							errs <- err
+							return
+						}
+						if _, err := db.ListUsers(ctx); err != nil {
+							errs <- err
+							return
+						}
+						if i%2 == 1 {
+							if err := db.DeleteUser(ctx, id); err != nil {
+								errs <- err
+								return
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			// Even-numbered users survive with their final name; odd ones are gone
+			users, err := db.ListUsers(ctx)
+			require.NoError(t, err)
+			byID := make(map[string]*User, len(users))
+			for _, user := range users {
+				byID[user.ID] = user
+			}
+			for w := 0; w < workers; w++ {
+				for i := 0; i < usersPerWorker; i++ {
+					id := fmt.Sprintf("w%d-%d", w, i)
+					user, ok := byID[id]
+					if i%2 == 1 {
+						assert.False(t, ok, id)
+						continue
+					}
+					require.True(t, ok, id)
+					assert.Equal(t, "updated", user.Name)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentVersionedUpdates races writers holding the same version;
+// exactly one of them may win
+func TestConcurrentVersionedUpdates(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	db := NewCachingDatabase(NewPersistentDatabase(logger, config, metrics), logger, config, metrics)
+
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	current, err := db.GetUser(ctx, "1")
+	require.NoError(t, err)
+
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			_, err := db.UpdateUser(ctx, &User{ID: "1", Name: fmt.Sprintf("writer %d", w), Version: current.Version})
+			results <- err
+		}(w)
+	}
+	wg.Wait()
+	close(results)
+
+	won := 0
+	for err := range results {
+		if err == nil {
+			won++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrVersionConflict)
+	}
+	assert.Equal(t, 1, won)
+
+	updated, err := db.GetUser(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, current.Version+1, updated.Version)
+	assert.Equal(t, current.CreatedAt, updated.CreatedAt)
+}
+
+// TestConcurrentRequests sends parallel HTTP requests through the rate limiter
+func TestConcurrentRequests(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	db := NewInMemoryDatabase(logger, config, metrics)
+	server := NewServer(NewUserService(db, logger, config, metrics), logger, config, metrics)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/user?id=1", nil))
+			assert.Contains(t, []int{http.StatusOK, http.StatusTooManyRequests}, rec.Code)
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkInMemoryParallelWrites measures write throughput across shards
+func BenchmarkInMemoryParallelWrites(b *testing.B) {
+	config := &Config{App: AppConfig{Environment: "production", LogLevel: "error"}}
+	db := NewInMemoryDatabase(NewLogger(config), config, NewMetrics(config))
+	ctx := context.Background()
+
+	var counter sync.Mutex
+	next := 0
+	b.RunParallel(func(pb *testing.PB) {
+		counter.Lock()
+		base := next
+		next++
+		counter.Unlock()
+
+		for i := 0; pb.Next(); i++ {
+			id := fmt.Sprintf("bench-%d-%d", base, i)
+			if _, err := db.CreateUser(ctx, NewUser(id, "bench")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
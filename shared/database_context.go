@@ -0,0 +1,53 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// queryContext derives a per-query deadline from DatabaseConfig.Timeout
+// A non-positive timeout leaves only the caller's deadline in effect
+func queryContext(ctx context.Context, config *DatabaseConfig) (context.Context, context.CancelFunc) {
+	if config.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+}
+
+// primaryReadKey marks a context whose reads must see every acknowledged write
+type primaryReadKey struct{}
+
+// withPrimaryRead returns a context whose reads bypass asynchronous replicas
+// Caches and read-modify-write callers use it so they never act on data an
+// acknowledged write has already replaced.
+func withPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+// primaryRead reports whether ctx was marked by withPrimaryRead
+func primaryRead(ctx context.Context) bool {
+	marked, _ := ctx.Value(primaryReadKey{}).(bool)
+	return marked
+}
+
+// simulateLatency waits for d, returning early if ctx is cancelled or expires
+func simulateLatency(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("database query aborted: %w", ctx.Err())
+	}
+}
+
+// contextError reports whether ctx is already done, before any work starts
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("database query aborted: %w", err)
+	}
+	return nil
+}
@@ -1,91 +1,240 @@
 package shared
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"sync"
 	"time"
 )
 
+// inMemoryShardCount is the number of independently locked partitions
+// Lookups for different IDs rarely contend, so reads and writes scale with cores
+const inMemoryShardCount = 32
+
+// userShard is one lock-protected partition of the in-memory user set
+type userShard struct {
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
 // InMemoryDatabase provides in-memory database functionality
+// Users are spread across shards by ID hash, each guarded by its own lock,
+// so it is safe for concurrent use
 type InMemoryDatabase struct {
-	logger         *Logger
-	config         *DatabaseConfig
-	metrics        *Metrics
-	users          map[string]string
-	cache          map[string]string
-	cacheEnabled   bool
+	logger   *Logger
+	config   *DatabaseConfig
+	metrics  *Metrics
+	shards   [inMemoryShardCount]*userShard
+	cursors  *cursorCodec
+	events   *eventHub
+	fixtures []string // loaded on Initialize
 }
 
 // NewInMemoryDatabase creates a new in-memory database instance
 func NewInMemoryDatabase(logger *Logger, config *Config, metrics *Metrics) *InMemoryDatabase {
-	return &InMemoryDatabase{
-		logger:       logger,
-		config:       &config.Database,
-		metrics:      metrics,
-		cacheEnabled: config.App.Features["cache_enabled"],
-		users: map[string]string{
-			"1": "Alice",
-			"2": "Bob",
-			"3": "Charlie",
-		},
-		cache: make(map[string]string),
+	d := &InMemoryDatabase{
+		logger:   logger,
+		config:   &config.Database,
+		metrics:  metrics,
+		cursors:  newCursorCodec(&config.Database),
+		events:   newEventHub(metrics),
+		fixtures: config.fixtureFiles(),
+	}
+	for i := range d.shards {
+		d.shards[i] = &userShard{users: make(map[string]*User)}
 	}
+	if config.seedsDefaults() {
+		for _, user := range []*User{
+			NewUser("1", "Alice"),
+			NewUser("2", "Bob"),
+			NewUser("3", "Charlie"),
+		} {
+			d.shardFor(user.ID).users[user.ID] = user
+		}
+	}
+	return d
+}
+
+// shardFor returns the shard that owns id
+func (d *InMemoryDatabase) shardFor(id string) *userShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return d.shards[h.Sum32()%inMemoryShardCount]
 }
 
 // Initialize sets up the database connection (mock)
-func (d *InMemoryDatabase) Initialize() error {
-	d.logger.Log("DATABASE", fmt.Sprintf("Initializing IN-MEMORY database with max connections: %d, timeout: %ds", 
+func (d *InMemoryDatabase) Initialize(ctx context.Context) error {
+	d.logger.Log("DATABASE", fmt.Sprintf("Initializing IN-MEMORY database with max connections: %d, timeout: %ds",
 		d.config.MaxConnections, d.config.Timeout))
-	
-	if d.cacheEnabled {
-		d.logger.Log("DATABASE", fmt.Sprintf("Cache enabled with size: %d", d.config.CacheSize))
+
+	if len(d.fixtures) > 0 {
+		users, err := loadFixtures(d.fixtures)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			d.shardFor(user.ID).users[user.ID] = user
+		}
+		d.logger.Log("DATABASE", fmt.Sprintf("Seeded %d users from %d fixture files", len(users), len(d.fixtures)))
 	}
-	
+
 	// Mock initialization with timeout
-	time.Sleep(100 * time.Millisecond)
-	return nil
+	return simulateLatency(ctx, 100*time.Millisecond)
 }
 
 // Close shuts down the database connection
-func (d *InMemoryDatabase) Close() error {
+func (d *InMemoryDatabase) Close(ctx context.Context) error {
 	d.logger.Log("DATABASE", "Closing database connection...")
 	// Mock cleanup logic
 	return nil
 }
 
 // GetUser retrieves a user by ID
-func (d *InMemoryDatabase) GetUser(id string) (string, error) {
-	// Track the database query
-	if d.metrics != nil {
-		d.metrics.RecordDBQuery()
-	}
-	
-	// Check cache first if enabled
-	if d.cacheEnabled {
-		if cached, ok := d.cache[id]; ok {
-			d.logger.Log("DATABASE", fmt.Sprintf("Cache hit for user ID: %s", id))
-			if d.metrics != nil {
-				d.metrics.RecordCacheHit()
-			}
-			return cached, nil
+func (d *InMemoryDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	// Simulate database query, bounded by the configured timeout
+	queryCtx, cancel := queryContext(ctx, d.config)
+	defer cancel()
+	if err := simulateLatency(queryCtx, 50*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	shard := d.shardFor(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if user, ok := shard.users[id]; ok {
+		return user.Clone(), nil
+	}
+	return nil, ErrUserNotFound
+}
+
+// GetUsers retrieves several users for the cost of a single query
+func (d *InMemoryDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	queryCtx, cancel := queryContext(ctx, d.config)
+	defer cancel()
+	if err := simulateLatency(queryCtx, 50*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*User, len(ids))
+	for _, id := range ids {
+		shard := d.shardFor(id)
+		shard.mu.RLock()
+		if user, ok := shard.users[id]; ok {
+			users[id] = user.Clone()
 		}
-		// Cache miss
-		if d.metrics != nil {
-			d.metrics.RecordCacheMiss()
+		shard.mu.RUnlock()
+	}
+	return users, nil
+}
+
+// ListUsers returns a copy of all stored users ordered by ID
+func (d *InMemoryDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0)
+	for _, shard := range d.shards {
+		shard.mu.RLock()
+		for _, user := range shard.users {
+			users = append(users, user.Clone())
 		}
+		shard.mu.RUnlock()
 	}
-	
-	d.logger.Log("DATABASE", fmt.Sprintf("Fetching user with ID: %s from database", id))
-	
-	// Simulate database query with configured timeout
-	time.Sleep(50 * time.Millisecond)
-	
-	if name, ok := d.users[id]; ok {
-		// Store in cache if enabled
-		if d.cacheEnabled && len(d.cache) < d.config.CacheSize {
-			d.cache[id] = name
-			d.logger.Log("DATABASE", fmt.Sprintf("Cached user %s", id))
+	sortUsers(users)
+	return users, nil
+}
+
+// QueryUsers returns one page of users matching query
+// Stored records are replaced rather than modified on update, so they can be
+// filtered and sorted after the shard locks are released
+func (d *InMemoryDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	var candidates []*User
+	for _, shard := range d.shards {
+		shard.mu.RLock()
+		for _, user := range shard.users {
+			candidates = append(candidates, user)
 		}
-		return name, nil
+		shard.mu.RUnlock()
+	}
+	return queryUsers(candidates, query, d.cursors)
+}
+
+// CreateUser stores a new user, failing if the ID is already taken
+func (d *InMemoryDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	shard := d.shardFor(user.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.users[user.ID]; ok {
+		return nil, ErrUserExists
+	}
+	stored := stampCreate(user)
+	shard.users[user.ID] = stored
+	d.events.publish(EventCreate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// UpdateUser replaces an existing user, keeping its creation time
+func (d *InMemoryDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	shard := d.shardFor(user.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	existing, ok := shard.users[user.ID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if err := checkVersion(existing, user); err != nil {
+		return nil, err
+	}
+	stored := stampUpdate(existing, user)
+	shard.users[user.ID] = stored
+	d.events.publish(EventUpdate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// DeleteUser removes a user
+func (d *InMemoryDatabase) DeleteUser(ctx context.Context, id string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	shard := d.shardFor(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.users[id]; !ok {
+		return ErrUserNotFound
 	}
-	return "", fmt.Errorf("user not found")
-}
\ No newline at end of file
+	delete(shard.users, id)
+	d.events.publish(EventDelete, id, nil)
+	return nil
+}
+
+// Watch streams change events after the given sequence number
+func (d *InMemoryDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return d.events.watch(ctx, after)
+}
+
+// putUser stores user verbatim, creating or replacing it
+func (d *InMemoryDatabase) putUser(ctx context.Context, user *User) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	shard := d.shardFor(user.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.users[user.ID] = user.Clone()
+	return nil
+}
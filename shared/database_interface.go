@@ -1,8 +1,61 @@
 package shared
 
+import (
+	"context"
+	"errors"
+)
+
+// Errors returned by Database implementations
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrReadOnly     = errors.New("database is read-only")
+	// ErrVersionConflict means the user changed since the caller read it
+	ErrVersionConflict = errors.New("user was modified concurrently")
+)
+
 // Database defines the interface for user data storage
+// Implementations return copies of stored records, so callers may modify them freely.
+// Every method honors cancellation and deadlines carried by ctx.
+// GetUsers looks up several users in one round trip; IDs that do not exist
+// are simply absent from the result. QueryUsers filters, sorts and pages.
+// Watch streams change events for successful writes; see ChangeEvent.
+// UpdateUser treats a non-zero user.Version as the version the caller expects
+// to replace and fails with ErrVersionConflict if the stored one differs. A
+// non-zero user.CreatedAt alongside it must match as well, since versions
+// start over when a user is deleted and created again.
 type Database interface {
-	Initialize() error
-	Close() error
-	GetUser(id string) (string, error)
-}
\ No newline at end of file
+	Initialize(ctx context.Context) error
+	Close(ctx context.Context) error
+	GetUser(ctx context.Context, id string) (*User, error)
+	GetUsers(ctx context.Context, ids []string) (map[string]*User, error)
+	ListUsers(ctx context.Context) ([]*User, error)
+	QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error)
+	CreateUser(ctx context.Context, user *User) (*User, error)
+	UpdateUser(ctx context.Context, user *User) (*User, error)
+	DeleteUser(ctx context.Context, id string) error
+	Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error)
+}
+
+// userPutter is implemented by backends that can store a record exactly as
+// given, timestamps included. Replication and rebalancing use it to copy
+// users between backends without restamping them, and without publishing
+// change events for what is not a change to the dataset.
+type userPutter interface {
+	putUser(ctx context.Context, user *User) error
+}
+
+// putUser copies user into db, preferring a verbatim write when supported
+func putUser(ctx context.Context, db Database, user *User) error {
+	if p, ok := db.(userPutter); ok {
+		return p.putUser(ctx, user)
+	}
+	// Replace unconditionally; the copy's version is not an expectation
+	user = user.Clone()
+	user.Version = 0
+	if _, err := db.UpdateUser(ctx, user); !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	_, err := db.CreateUser(ctx, user)
+	return err
+}
@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// newMemberDatabase builds one child backend of a composite database
+// Each member gets its own data directory under DataDir, so several persistent
+// members never share a file. Fixtures are left to the composite, which seeds
+// them through itself so they land where its routing expects them.
+func newMemberDatabase(kind, name string, logger *Logger, config *Config, metrics *Metrics) (Database, error) {
+	memberConfig := *config
+	if len(config.fixtureFiles()) > 0 {
+		memberConfig.Database.Fixtures = nil
+		memberConfig.Database.EnvironmentFixtures = nil
+		memberConfig.Database.StartEmpty = true
+	}
+	baseDir := config.Database.DataDir
+	if baseDir == "" {
+		baseDir = os.TempDir()
+	}
+	memberConfig.Database.DataDir = filepath.Join(baseDir, name)
+
+	switch kind {
+	case "inmemory":
+		return NewInMemoryDatabase(logger, &memberConfig, metrics), nil
+	case "persistent":
+		return NewPersistentDatabase(logger, &memberConfig, metrics), nil
+	default:
+		return nil, fmt.Errorf("unsupported backend %q for %s", kind, name)
+	}
+}
+
+// seedComposite loads the configured fixtures into a composite database whose
+// members all started empty, writing each user through put
+func seedComposite(ctx context.Context, logger *Logger, config *Config, empty bool, put func(*User) error) error {
+	files := config.fixtureFiles()
+	if len(files) == 0 || !empty {
+		return nil
+	}
+	users, err := loadFixtures(files)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := put(user); err != nil {
+			return fmt.Errorf("failed to seed user %s: %w", user.ID, err)
+		}
+	}
+	logger.Log("DATABASE", fmt.Sprintf("Seeded %d users from %d fixture files", len(users), len(files)))
+	return nil
+}
@@ -0,0 +1,371 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Middleware decorates a Database with cross-cutting behavior such as
+// logging, metrics or resilience. Any backend gets them by being wrapped.
+type Middleware func(Database) Database
+
+// Middleware names accepted in DatabaseConfig.Middleware
+const (
+	MiddlewareLogging        = "logging"
+	MiddlewareMetrics        = "metrics"
+	MiddlewareRetry          = "retry"
+	MiddlewareCircuitBreaker = "circuit_breaker"
+)
+
+// ErrCircuitOpen is returned while the circuit breaker is rejecting calls
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Chain wraps db in middlewares; the first middleware is the outermost
+func Chain(db Database, middlewares ...Middleware) Database {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		db = middlewares[i](db)
+	}
+	return db
+}
+
+// NewMiddlewares builds the middleware listed in config.Database.Middleware, in order
+func NewMiddlewares(logger *Logger, config *Config, metrics *Metrics) ([]Middleware, error) {
+	var middlewares []Middleware
+	for _, name := range config.Database.Middleware {
+		switch name {
+		case MiddlewareLogging:
+			middlewares = append(middlewares, func(db Database) Database {
+				return NewLoggingDatabase(db, logger)
+			})
+		case MiddlewareMetrics:
+			middlewares = append(middlewares, func(db Database) Database {
+				return NewInstrumentedDatabase(db, metrics)
+			})
+		case MiddlewareRetry:
+			middlewares = append(middlewares, func(db Database) Database {
+				return NewRetryingDatabase(db, logger, config, metrics)
+			})
+		case MiddlewareCircuitBreaker:
+			middlewares = append(middlewares, func(db Database) Database {
+				return NewCircuitBreakerDatabase(db, logger, config, metrics)
+			})
+		default:
+			return nil, fmt.Errorf("unknown database middleware %q", name)
+		}
+	}
+	return middlewares, nil
+}
+
+// isPermanent reports errors that describe the request rather than the
+// backend's health; they are never retried and never trip the breaker.
+// A full pool is load, not a fault: retrying it only adds to the load.
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrUserNotFound) ||
+		errors.Is(err, ErrUserExists) ||
+		errors.Is(err, ErrPoolExhausted) ||
+		errors.Is(err, ErrReadOnly) ||
+		errors.Is(err, ErrVersionConflict) ||
+		errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// readOps are the operations that can be repeated without changing anything
+var readOps = map[string]bool{
+	"get_user":    true,
+	"get_users":   true,
+	"list_users":  true,
+	"query_users": true,
+}
+
+// interceptor runs every Database call through a single function, so each
+// middleware only implements the behavior it adds
+type interceptor struct {
+	next      Database
+	intercept func(ctx context.Context, op string, call func(context.Context) error) error
+}
+
+func (i *interceptor) Initialize(ctx context.Context) error {
+	return i.next.Initialize(ctx)
+}
+
+func (i *interceptor) Close(ctx context.Context) error {
+	return i.next.Close(ctx)
+}
+
+func (i *interceptor) GetUser(ctx context.Context, id string) (*User, error) {
+	var user *User
+	err := i.intercept(ctx, "get_user", func(ctx context.Context) (err error) {
+		user, err = i.next.GetUser(ctx, id)
+		return err
+	})
+	return user, err
+}
+
+func (i *interceptor) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	var users map[string]*User
+	err := i.intercept(ctx, "get_users", func(ctx context.Context) (err error) {
+		users, err = i.next.GetUsers(ctx, ids)
+		return err
+	})
+	return users, err
+}
+
+func (i *interceptor) ListUsers(ctx context.Context) ([]*User, error) {
+	var users []*User
+	err := i.intercept(ctx, "list_users", func(ctx context.Context) (err error) {
+		users, err = i.next.ListUsers(ctx)
+		return err
+	})
+	return users, err
+}
+
+func (i *interceptor) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	var page *UserPage
+	err := i.intercept(ctx, "query_users", func(ctx context.Context) (err error) {
+		page, err = i.next.QueryUsers(ctx, query)
+		return err
+	})
+	return page, err
+}
+
+func (i *interceptor) CreateUser(ctx context.Context, user *User) (*User, error) {
+	var created *User
+	err := i.intercept(ctx, "create_user", func(ctx context.Context) (err error) {
+		created, err = i.next.CreateUser(ctx, user)
+		return err
+	})
+	return created, err
+}
+
+func (i *interceptor) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	var updated *User
+	err := i.intercept(ctx, "update_user", func(ctx context.Context) (err error) {
+		updated, err = i.next.UpdateUser(ctx, user)
+		return err
+	})
+	return updated, err
+}
+
+func (i *interceptor) DeleteUser(ctx context.Context, id string) error {
+	return i.intercept(ctx, "delete_user", func(ctx context.Context) error {
+		return i.next.DeleteUser(ctx, id)
+	})
+}
+
+// Watch is long-lived, so it bypasses per-call middleware
+func (i *interceptor) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return i.next.Watch(ctx, after)
+}
+
+// NewLoggingDatabase logs every operation with its duration and outcome
+func NewLoggingDatabase(db Database, logger *Logger) Database {
+	return &interceptor{
+		next: db,
+		intercept: func(ctx context.Context, op string, call func(context.Context) error) error {
+			start := time.Now()
+			err := call(ctx)
+			if err != nil {
+				logger.Log("DATABASE", fmt.Sprintf("%s failed after %v: %v", op, time.Since(start), err))
+			} else {
+				logger.Log("DATABASE", fmt.Sprintf("%s completed in %v", op, time.Since(start)))
+			}
+			return err
+		},
+	}
+}
+
+// NewInstrumentedDatabase records query counts, latency and errors per operation
+func NewInstrumentedDatabase(db Database, metrics *Metrics) Database {
+	return &interceptor{
+		next: db,
+		intercept: func(ctx context.Context, op string, call func(context.Context) error) error {
+			start := time.Now()
+			err := call(ctx)
+			if metrics != nil {
+				metrics.RecordDBQuery()
+				metrics.RecordDBOperation(op, time.Since(start), err != nil && !isPermanent(err))
+			}
+			return err
+		},
+	}
+}
+
+// NewRetryingDatabase retries transient failures with jittered exponential backoff
+// Writes are only retried when retry_writes is configured.
+func NewRetryingDatabase(db Database, logger *Logger, config *Config, metrics *Metrics) Database {
+	retry := config.Database.Retry
+	attempts := retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	base := time.Duration(retry.BaseDelay) * time.Millisecond
+	maxDelay := time.Duration(retry.MaxDelay) * time.Millisecond
+
+	return &interceptor{
+		next: db,
+		intercept: func(ctx context.Context, op string, call func(context.Context) error) error {
+			if !readOps[op] && !retry.RetryWrites {
+				return call(ctx)
+			}
+			var err error
+			for attempt := 1; ; attempt++ {
+				err = call(ctx)
+				if err == nil || isPermanent(err) || attempt >= attempts {
+					return err
+				}
+
+				delay := backoff(base, maxDelay, attempt)
+				logger.Log("DATABASE", fmt.Sprintf("%s attempt %d/%d failed, retrying in %v: %v",
+					op, attempt, attempts, delay, err))
+				if metrics != nil {
+					metrics.RecordDBRetry()
+				}
+				if waitErr := simulateLatency(ctx, delay); waitErr != nil {
+					return err
+				}
+			}
+		},
+	}
+}
+
+// backoff returns a "full jitter" delay: random in [0, min(max, base*2^(attempt-1))]
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	// Saturate instead of letting the shift overflow into a negative delay
+	delay := time.Duration(math.MaxInt64 - 1)
+	if shift := attempt - 1; shift < 63 && base <= delay>>shift {
+		delay = base << shift
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker fails fast after repeated backend failures, then lets a
+// single trial call through once the open period has passed
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half-open trial call is in flight
+	threshold int
+	openFor   time.Duration
+	logger    *Logger
+	metrics   *Metrics
+}
+
+// allow reports whether a call may proceed
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.logger.Log("DATABASE", "Circuit breaker closed")
+			b.setState(circuitClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.logger.Log("DATABASE", fmt.Sprintf("Circuit breaker opened after %d consecutive failures", b.failures))
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+		if b.metrics != nil {
+			b.metrics.RecordCircuitTrip()
+		}
+	}
+}
+
+// abandon releases a half-open trial without judging the backend
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// setState changes state and publishes it; caller holds b.mu
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	if b.metrics != nil {
+		b.metrics.SetCircuitState(state)
+	}
+}
+
+// NewCircuitBreakerDatabase stops calling db after FailureThreshold consecutive
+// failures and rejects calls with ErrCircuitOpen for OpenSeconds
+func NewCircuitBreakerDatabase(db Database, logger *Logger, config *Config, metrics *Metrics) Database {
+	cb := config.Database.CircuitBreaker
+	breaker := &circuitBreaker{
+		threshold: cb.FailureThreshold,
+		openFor:   time.Duration(cb.OpenSeconds) * time.Second,
+		logger:    logger,
+		metrics:   metrics,
+	}
+	if breaker.threshold < 1 {
+		breaker.threshold = 1
+	}
+	breaker.setState(circuitClosed)
+
+	return &interceptor{
+		next: db,
+		intercept: func(ctx context.Context, op string, call func(context.Context) error) error {
+			if !breaker.allow() {
+				return fmt.Errorf("%s: %w", op, ErrCircuitOpen)
+			}
+			err := call(ctx)
+			// Caller cancellations and pool rejections say nothing about the
+			// backend, so they don't count either way
+			if errors.Is(err, context.Canceled) || errors.Is(err, ErrPoolExhausted) {
+				breaker.abandon()
+				return err
+			}
+			breaker.record(err != nil && (errors.Is(err, context.DeadlineExceeded) || !isPermanent(err)))
+			return err
+		},
+	}
+}
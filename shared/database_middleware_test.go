@@ -0,0 +1,134 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMiddlewareTestConfig(middleware ...string) *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			Middleware:     middleware,
+			Retry:          RetryConfig{MaxAttempts: 3, BaseDelay: 1, MaxDelay: 2},
+			CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenSeconds: 60},
+		},
+		App: AppConfig{
+			Environment: "test",
+			Features:    map[string]bool{"metrics_enabled": true},
+		},
+	}
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	config := newMiddlewareTestConfig(MiddlewareMetrics, MiddlewareRetry)
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	mock := NewMockDatabase()
+
+	middlewares, err := NewMiddlewares(logger, config, metrics)
+	require.NoError(t, err)
+	db := Chain(mock, middlewares...)
+	ctx := context.Background()
+
+	// Transient failures are retried up to MaxAttempts
+	mock.ShouldError = true
+	_, err = db.GetUser(ctx, "test1")
+	assert.Error(t, err)
+	assert.Equal(t, 3, mock.GetUserCalls)
+
+	// Not-found is an answer, not a failure
+	mock.ShouldError = false
+	mock.GetUserCalls = 0
+	_, err = db.GetUser(ctx, "missing")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.Equal(t, 1, mock.GetUserCalls)
+
+	// A failed write may have been applied, so it is not retried by default
+	mock.ShouldError = true
+	_, err = db.CreateUser(ctx, NewUser("9", "Nina"))
+	assert.Error(t, err)
+	assert.Equal(t, 1, mock.CreateUserCalls)
+
+	stats := metrics.GetStats()
+	assert.Contains(t, stats, "get_user: 2 calls, 1 errors")
+	assert.Contains(t, stats, "Retries: 2")
+
+	// Unless write retries are opted into
+	config.Database.Retry.RetryWrites = true
+	db = NewRetryingDatabase(mock, logger, config, metrics)
+	mock.CreateUserCalls = 0
+	_, err = db.CreateUser(ctx, NewUser("9", "Nina"))
+	assert.Error(t, err)
+	assert.Equal(t, 3, mock.CreateUserCalls)
+}
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	config := newMiddlewareTestConfig(MiddlewareCircuitBreaker)
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	mock := NewMockDatabase()
+
+	middlewares, err := NewMiddlewares(logger, config, metrics)
+	require.NoError(t, err)
+	db := Chain(mock, middlewares...)
+	ctx := context.Background()
+
+	mock.ShouldError = true
+	for i := 0; i < 2; i++ {
+		_, err = db.GetUser(ctx, "test1")
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+
+	// Threshold reached - calls fail fast without touching the backend
+	_, err = db.GetUser(ctx, "test1")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, mock.GetUserCalls)
+	assert.Contains(t, metrics.GetStats(), "Circuit Breaker: open (trips: 1)")
+}
+
+func TestUnknownMiddleware(t *testing.T) {
+	config := newMiddlewareTestConfig("tracing")
+	_, err := NewMiddlewares(NewLogger(config), config, NewMetrics(config))
+	assert.ErrorContains(t, err, `unknown database middleware "tracing"`)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	// Large attempt counts saturate instead of overflowing, with or without a cap
+	for _, attempt := range []int{1, 20, 63, 64, 1000} {
+		assert.GreaterOrEqual(t, backoff(time.Second, 0, attempt), time.Duration(0), attempt)
+		assert.LessOrEqual(t, backoff(time.Second, time.Minute, attempt), time.Minute, attempt)
+	}
+	assert.LessOrEqual(t, backoff(time.Millisecond, 0, 3), 4*time.Millisecond)
+	assert.Zero(t, backoff(0, time.Minute, 5))
+}
+
+func TestPoolExhaustionMiddleware(t *testing.T) {
+	config := newMiddlewareTestConfig(MiddlewareRetry, MiddlewareCircuitBreaker)
+	config.Database.CircuitBreaker.FailureThreshold = 1
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	calls := 0
+	exhausted := func(context.Context) error {
+		calls++
+		return ErrPoolExhausted
+	}
+	ctx := context.Background()
+
+	// Rejections are not retried
+	retry := NewRetryingDatabase(NewMockDatabase(), logger, config, metrics).(*interceptor)
+	assert.ErrorIs(t, retry.intercept(ctx, "get_user", exhausted), ErrPoolExhausted)
+	assert.Equal(t, 1, calls)
+
+	// Nor do they open the breaker
+	breaker := NewCircuitBreakerDatabase(NewMockDatabase(), logger, config, metrics).(*interceptor)
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, breaker.intercept(ctx, "get_user", exhausted), ErrPoolExhausted)
+	}
+	assert.Equal(t, 4, calls)
+	assert.Contains(t, metrics.GetStats(), "Circuit Breaker: closed (trips: 0)")
+}
@@ -1,36 +1,47 @@
 package shared
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
 // MockDatabase is a test double for the Database interface
 type MockDatabase struct {
 	// Control behavior
-	Users           map[string]string
+	Users           map[string]*User
 	ShouldError     bool
 	ErrorMessage    string
+	Delay           time.Duration // Simulated latency for GetUser, honoring ctx
 	InitializeCalls int
 	CloseCalls      int
 	GetUserCalls    int
-	
+	GetUsersCalls   int
+	ListUsersCalls  int
+	QueryUsersCalls int
+	CreateUserCalls int
+	UpdateUserCalls int
+	DeleteUserCalls int
+
 	// For assertions
 	LastRequestedID string
+
+	events *eventHub
 }
 
 // NewMockDatabase creates a new mock database for testing
 func NewMockDatabase() *MockDatabase {
 	return &MockDatabase{
-		Users: map[string]string{
-			"test1": "Test User 1",
-			"test2": "Test User 2",
-			"mock":  "Mock User",
+		Users: map[string]*User{
+			"test1": NewUser("test1", "Test User 1"),
+			"test2": NewUser("test2", "Test User 2"),
+			"mock":  NewUser("mock", "Mock User"),
 		},
 	}
 }
 
 // Initialize mock implementation
-func (m *MockDatabase) Initialize() error {
+func (m *MockDatabase) Initialize(ctx context.Context) error {
 	m.InitializeCalls++
 	if m.ShouldError {
 		return fmt.Errorf("mock initialize error: %s", m.ErrorMessage)
@@ -39,7 +50,7 @@ func (m *MockDatabase) Initialize() error {
 }
 
 // Close mock implementation
-func (m *MockDatabase) Close() error {
+func (m *MockDatabase) Close(ctx context.Context) error {
 	m.CloseCalls++
 	if m.ShouldError {
 		return fmt.Errorf("mock close error: %s", m.ErrorMessage)
@@ -48,17 +59,160 @@ func (m *MockDatabase) Close() error {
 }
 
 // GetUser mock implementation
-func (m *MockDatabase) GetUser(id string) (string, error) {
+func (m *MockDatabase) GetUser(ctx context.Context, id string) (*User, error) {
 	m.GetUserCalls++
 	m.LastRequestedID = id
-	
+
 	if m.ShouldError {
-		return "", fmt.Errorf("mock error: %s", m.ErrorMessage)
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if m.Delay > 0 {
+		if err := simulateLatency(ctx, m.Delay); err != nil {
+			return nil, err
+		}
 	}
-	
+
 	if user, ok := m.Users[id]; ok {
-		return user, nil
+		return user.Clone(), nil
+	}
+
+	return nil, ErrUserNotFound
+}
+
+// GetUsers mock implementation
+func (m *MockDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	m.GetUsersCalls++
+
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if m.Delay > 0 {
+		if err := simulateLatency(ctx, m.Delay); err != nil {
+			return nil, err
+		}
+	}
+
+	users := make(map[string]*User, len(ids))
+	for _, id := range ids {
+		if user, ok := m.Users[id]; ok {
+			users[id] = user.Clone()
+		}
+	}
+	return users, nil
+}
+
+// ListUsers mock implementation
+func (m *MockDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	m.ListUsersCalls++
+
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(m.Users))
+	for _, user := range m.Users {
+		users = append(users, user.Clone())
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+// QueryUsers mock implementation
+func (m *MockDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	m.QueryUsersCalls++
+
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(m.Users))
+	for _, user := range m.Users {
+		users = append(users, user)
+	}
+	return queryUsers(users, query, newCursorCodec(&DatabaseConfig{}))
+}
+
+// CreateUser mock implementation
+func (m *MockDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	m.CreateUserCalls++
+	m.LastRequestedID = user.ID
+
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if _, ok := m.Users[user.ID]; ok {
+		return nil, ErrUserExists
+	}
+	stored := stampCreate(user)
+	m.Users[user.ID] = stored
+	m.feed().publish(EventCreate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// UpdateUser mock implementation
+func (m *MockDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	m.UpdateUserCalls++
+	m.LastRequestedID = user.ID
+
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
 	}
-	
-	return "", fmt.Errorf("user not found")
-}
\ No newline at end of file
+	existing, ok := m.Users[user.ID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if err := checkVersion(existing, user); err != nil {
+		return nil, err
+	}
+	stored := stampUpdate(existing, user)
+	m.Users[user.ID] = stored
+	m.feed().publish(EventUpdate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// DeleteUser mock implementation
+func (m *MockDatabase) DeleteUser(ctx context.Context, id string) error {
+	m.DeleteUserCalls++
+	m.LastRequestedID = id
+
+	if m.ShouldError {
+		return fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	if _, ok := m.Users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(m.Users, id)
+	m.feed().publish(EventDelete, id, nil)
+	return nil
+}
+
+// Watch mock implementation
+func (m *MockDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	if m.ShouldError {
+		return nil, fmt.Errorf("mock error: %s", m.ErrorMessage)
+	}
+	return m.feed().watch(ctx, after)
+}
+
+// feed returns the mock's change feed, creating it on first use
+func (m *MockDatabase) feed() *eventHub {
+	if m.events == nil {
+		m.events = newEventHub(nil)
+	}
+	return m.events
+}
@@ -1,148 +1,750 @@
 package shared
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // PersistentDatabase provides file-based persistent database functionality
 // This implementation demonstrates an alternative to the in-memory database
 type PersistentDatabase struct {
-	logger       *Logger
-	config       *DatabaseConfig
-	metrics      *Metrics
-	mu           sync.RWMutex
-	dataFile     string
-	users        map[string]string
-	cache        map[string]string
-	cacheEnabled bool
+	logger   *Logger
+	config   *DatabaseConfig
+	metrics  *Metrics
+	mu       sync.RWMutex
+	dataFile string
+	filePerm os.FileMode
+	readOnly bool
+	journal  *journal
+	lock     *fileLock   // held from Initialize to Close unless read-only
+	cipher   *fileCipher // nil unless encryption is configured
+	rekey    bool        // data file needs re-encrypting with the current key
+	users    map[string]*User
+	cursors  *cursorCodec
+	events   *eventHub
+	fixtures []string
+	seed     bool // Add the built-in demo users to a new data file
+
+	// unsaved counts mutations made since the last snapshot; they are safe in
+	// the journal, but replaying a long journal slows down the next start
+	unsaved    atomic.Int64
+	lastChange time.Time // when memory last changed; guarded by mu
+
+	// External edit detection
+	disk      atomic.Pointer[diskState]
+	stopEdits chan struct{}
+	editsDone chan struct{}
+
+	// Background autosave: compaction of the journal into the snapshot
+	compactNow  chan struct{}
+	stopCompact chan struct{}
+	compactDone chan struct{}
 }
 
+const (
+	// defaultCompactionInterval applies when compaction_interval_seconds is unset
+	defaultCompactionInterval = time.Minute
+	// defaultAutosaveMutations applies when autosave_mutations is unset
+	defaultAutosaveMutations = 1000
+	// dataFileName is the snapshot file created inside the data directory
+	dataFileName = "demo_users.json"
+)
+
 // NewPersistentDatabase creates a new persistent database instance
+// The data file lives in DatabaseConfig.DataDir, falling back to the system temp directory
 func NewPersistentDatabase(logger *Logger, config *Config, metrics *Metrics) *PersistentDatabase {
 	return &PersistentDatabase{
-		logger:       logger,
-		config:       &config.Database,
-		metrics:      metrics,
-		cacheEnabled: config.App.Features["cache_enabled"],
-		dataFile:     filepath.Join(os.TempDir(), "demo_users.json"),
-		users:        make(map[string]string),
-		cache:        make(map[string]string),
+		logger:   logger,
+		config:   &config.Database,
+		metrics:  metrics,
+		dataFile: filepath.Join(config.Database.storageDir(), dataFileName),
+		readOnly: config.Database.ReadOnly,
+		users:    make(map[string]*User),
+		cursors:  newCursorCodec(&config.Database),
+		events:   newEventHub(metrics),
+		fixtures: config.fixtureFiles(),
+		seed:     config.seedsDefaults(),
 	}
 }
 
 // Initialize sets up the database and loads data from file
-func (d *PersistentDatabase) Initialize() error {
+// A writable database locks the data file first, so a second process
+// pointed at the same data_dir fails instead of overwriting its changes.
+func (d *PersistentDatabase) Initialize(ctx context.Context) (err error) {
 	d.logger.Log("DATABASE", fmt.Sprintf("Initializing PERSISTENT database with file: %s", d.dataFile))
-	d.logger.Log("DATABASE", fmt.Sprintf("Max connections: %d, timeout: %ds", 
+	d.logger.Log("DATABASE", fmt.Sprintf("Max connections: %d, timeout: %ds",
 		d.config.MaxConnections, d.config.Timeout))
-	
-	if d.cacheEnabled {
-		d.logger.Log("DATABASE", fmt.Sprintf("Cache enabled with size: %d", d.config.CacheSize))
+
+	if err := d.prepareStorage(); err != nil {
+		return err
 	}
-	
+	if !d.readOnly {
+		if d.lock, err = acquireFileLock(d.dataFile, d.filePerm); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				d.closeFiles()
+			}
+		}()
+	}
+	cipher, err := newFileCipher(&d.config.Encryption)
+	if err != nil {
+		return err
+	}
+	d.cipher = cipher
+	if cipher != nil {
+		d.logger.Log("DATABASE", fmt.Sprintf("Encryption at rest enabled with key %s", cipher.current.id))
+	}
+
 	// Try to load existing data
 	if err := d.loadData(); err != nil {
+		// A snapshot that exists but can't be read must never be silently replaced
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load data file: %w", err)
+		}
+		if d.readOnly {
+			return fmt.Errorf("data file %s does not exist and the database is read-only", d.dataFile)
+		}
 		// If file doesn't exist, create initial data
 		d.logger.Log("DATABASE", "No existing data found, creating initial dataset")
-		d.users = map[string]string{
-			"1": "Alice",
-			"2": "Bob", 
-			"3": "Charlie",
-			"4": "Diana",      // Additional users in persistent DB
-			"5": "Edward",
-			"6": "Fiona",
+		users, err := d.initialUsers()
+		if err != nil {
+			return err
 		}
+		d.users = users
 		// Save initial data
 		if err := d.saveData(); err != nil {
 			return fmt.Errorf("failed to save initial data: %w", err)
 		}
 	}
-	
+
+	// Recover mutations made after the last snapshot
+	if d.readOnly {
+		if err := d.replayReadOnly(); err != nil {
+			return err
+		}
+	} else {
+		if err := d.openJournal(); err != nil {
+			return err
+		}
+	}
+
+	// Rotated keys and newly enabled encryption take effect on disk right away
+	if d.rekey {
+		if d.readOnly {
+			d.logger.Log("DATABASE", "Read-only: data file is not re-encrypted with the current key")
+		} else {
+			if err := d.compact(); err != nil {
+				return fmt.Errorf("failed to re-encrypt data file: %w", err)
+			}
+			d.logger.Log("DATABASE", fmt.Sprintf("Re-encrypted data file with key %s", d.cipher.current.id))
+		}
+		d.rekey = false
+	}
+
 	// Simulate longer initialization for persistent DB
-	time.Sleep(200 * time.Millisecond)
+	if err := simulateLatency(ctx, 200*time.Millisecond); err != nil {
+		return err
+	}
+
+	// Background work starts last, so a failed Initialize never leaves it
+	// running against files it has already given up
+	if !d.readOnly {
+		d.startCompaction()
+	}
+	d.startEditWatch()
 	return nil
 }
 
+// initialUsers returns the dataset for a new data file: the configured
+// fixtures, nothing when starting empty, or the built-in demo users
+func (d *PersistentDatabase) initialUsers() (map[string]*User, error) {
+	users := make(map[string]*User)
+	if len(d.fixtures) > 0 {
+		seed, err := loadFixtures(d.fixtures)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range seed {
+			users[user.ID] = user
+		}
+		d.logger.Log("DATABASE", fmt.Sprintf("Seeded %d users from %d fixture files", len(seed), len(d.fixtures)))
+		return users, nil
+	}
+	if !d.seed {
+		return users, nil
+	}
+	for _, user := range []*User{
+		NewUser("1", "Alice"),
+		NewUser("2", "Bob"),
+		NewUser("3", "Charlie"),
+		NewUser("4", "Diana"), // Additional users in persistent DB
+		NewUser("5", "Edward"),
+		NewUser("6", "Fiona"),
+	} {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
 // loadData reads user data from file
+// Files written with an older schema are upgraded through the registered
+// migrations; the original is kept as a backup before the upgrade is saved
 func (d *PersistentDatabase) loadData() error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-	
+
 	data, err := os.ReadFile(d.dataFile)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	snap, err := d.decodeSnapshot(data)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.users = snap.users
+	d.rekey = snap.rekey
+	d.rememberDisk(data)
+	d.mu.Unlock()
+
+	if len(snap.migrations) == 0 {
+		return nil
+	}
+	for _, step := range snap.migrations {
+		d.logger.Log("DATABASE", fmt.Sprintf("Applied schema migration %s", step))
+	}
+	if d.readOnly {
+		d.logger.Log("DATABASE", fmt.Sprintf("Read-only: schema version %d upgraded in memory only", snap.version))
+		return nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", d.dataFile, snap.version)
+	if data, err = d.cipher.seal(sealSnapshot, snap.plaintext); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(backup, data, d.filePerm); err != nil {
+		return fmt.Errorf("failed to back up data file before migration: %w", err)
+	}
+	d.logger.Log("DATABASE", fmt.Sprintf("Backed up schema version %d data file to %s", snap.version, backup))
+	return d.saveData()
+}
+
+// snapshot is the decoded content of a data file
+type snapshot struct {
+	users      map[string]*User
+	plaintext  []byte   // file content after decryption
+	version    int      // schema version the file was written with
+	migrations []string // upgrades applied while decoding
+	rekey      bool     // not encrypted with the current key
+}
+
+// decodeSnapshot decrypts data, upgrades it to the current schema and
+// returns the users it holds
+func (d *PersistentDatabase) decodeSnapshot(data []byte) (*snapshot, error) {
+	plaintext, rekey, err := d.cipher.open(sealSnapshot, data)
+	if err != nil {
+		return nil, fmt.Errorf("data file %s %w", d.dataFile, err)
+	}
+	version, section, err := decodeDataFile(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	section, applied, err := migrateSchema(version, section)
+	if err != nil {
+		return nil, err
+	}
+
+	var users map[string]*User
+	if err := json.Unmarshal(section, &users); err != nil {
+		return nil, err
+	}
+	if users == nil {
+		users = make(map[string]*User)
+	}
+	for id, user := range users {
+		if user == nil {
+			return nil, fmt.Errorf("invalid record for user %s: null", id)
+		}
+		user.ID = id
+	}
+	return &snapshot{users: users, plaintext: plaintext, version: version, migrations: applied, rekey: rekey}, nil
+}
+
+// prepareStorage creates the data directory and validates its permissions
+// A writable database needs a writable directory; an existing data file that is
+// more permissive than file_mode is tightened (or reported when read-only)
+func (d *PersistentDatabase) prepareStorage() error {
+	perm, err := d.config.FilePerm()
 	if err != nil {
 		return err
 	}
-	
-	return json.Unmarshal(data, &d.users)
+	d.filePerm = perm
+
+	dir := filepath.Dir(d.dataFile)
+	if !d.readOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create data directory %s: %w", dir, err)
+		}
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("data directory %s is not accessible: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("data directory %s is not a directory", dir)
+	}
+
+	if !d.readOnly {
+		// Probe with a real file rather than trusting mode bits
+		probe, err := os.CreateTemp(dir, ".write-check-*")
+		if err != nil {
+			return fmt.Errorf("data directory %s is not writable: %w", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	info, err = os.Stat(d.dataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("data file %s is not accessible: %w", d.dataFile, err)
+	}
+	if extra := info.Mode().Perm() &^ perm; extra != 0 {
+		if d.readOnly {
+			d.logger.Log("DATABASE", fmt.Sprintf("Warning: data file mode %v is wider than configured %v",
+				info.Mode().Perm(), perm))
+			return nil
+		}
+		d.logger.Log("DATABASE", fmt.Sprintf("Tightening data file mode from %v to %v", info.Mode().Perm(), perm))
+		if err := os.Chmod(d.dataFile, perm); err != nil {
+			return fmt.Errorf("failed to set data file permissions: %w", err)
+		}
+	}
+	return nil
+}
+
+// replayReadOnly applies a leftover journal in memory without touching disk
+func (d *PersistentDatabase) replayReadOnly() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	replayed, err := replayJournal(d.dataFile+".journal", d.cipher, d.applyEntry)
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		d.logger.Log("DATABASE", fmt.Sprintf("Read-only: applied %d journal entries in memory", replayed))
+	}
+	return nil
 }
 
-// saveData writes user data to file
+// saveData atomically writes user data to file
 func (d *PersistentDatabase) saveData() error {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	
-	data, err := json.MarshalIndent(d.users, "", "  ")
+
+	return d.writeSnapshot()
+}
+
+// writeSnapshot replaces the data file with the current users; caller holds d.mu
+func (d *PersistentDatabase) writeSnapshot() (err error) {
+	if d.metrics != nil {
+		defer func(start time.Time) {
+			d.metrics.RecordSave(time.Since(start), err != nil)
+		}(time.Now())
+	}
+
+	data, err := encodeDataFile(d.users)
 	if err != nil {
 		return err
 	}
-	
-	return os.WriteFile(d.dataFile, data, 0644)
+	if data, err = d.cipher.seal(sealSnapshot, data); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(d.dataFile, data, d.filePerm); err != nil {
+		return err
+	}
+	d.rememberDisk(data)
+	return nil
 }
 
-// Close saves data and shuts down the database
-func (d *PersistentDatabase) Close() error {
-	d.logger.Log("DATABASE", "Saving data before closing persistent database...")
-	if err := d.saveData(); err != nil {
-		d.logger.Log("DATABASE", fmt.Sprintf("Error saving data: %v", err))
+// openJournal replays any journal left by a previous run, folds it into the
+// snapshot and opens the journal for new mutations
+func (d *PersistentDatabase) openJournal() error {
+	path := d.dataFile + ".journal"
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	replayed, err := replayJournal(path, d.cipher, d.applyEntry)
+	if err != nil {
 		return err
 	}
-	d.logger.Log("DATABASE", "Persistent database closed successfully")
+
+	j, err := openJournal(path, d.filePerm, d.cipher)
+	if err != nil {
+		return err
+	}
+	d.journal = j
+
+	if replayed > 0 {
+		d.logger.Log("DATABASE", fmt.Sprintf("Replayed %d journal entries from previous run", replayed))
+	}
+
+	// Compact whenever anything was left behind, including a torn final line,
+	// so new entries never get appended after a partial one
+	if j.size > 0 {
+		return d.compactLocked()
+	}
 	return nil
 }
 
-// GetUser retrieves a user by ID
-func (d *PersistentDatabase) GetUser(id string) (string, error) {
-	// Track the database query
-	if d.metrics != nil {
-		d.metrics.RecordDBQuery()
-	}
-	
-	// Check cache first if enabled
-	if d.cacheEnabled {
-		if cached, ok := d.cache[id]; ok {
-			d.logger.Log("DATABASE", fmt.Sprintf("Cache hit for user ID: %s", id))
-			if d.metrics != nil {
-				d.metrics.RecordCacheHit()
+// applyEntry applies a journal entry to the in-memory map; caller holds d.mu
+func (d *PersistentDatabase) applyEntry(entry journalEntry) {
+	switch entry.Op {
+	case journalOpPut:
+		d.users[entry.ID] = entry.User
+	case journalOpDelete:
+		delete(d.users, entry.ID)
+	}
+}
+
+// recordLocked appends entry to the journal and then applies it; caller holds d.mu
+func (d *PersistentDatabase) recordLocked(entry journalEntry) error {
+	if d.journal != nil {
+		if err := d.journal.Append(entry); err != nil {
+			if errors.Is(err, ErrJournalFailed) {
+				// A snapshot starts the journal over, letting later mutations through
+				if err := d.compactLocked(); err != nil {
+					d.logger.Log("DATABASE", fmt.Sprintf("Error compacting failed journal: %v", err))
+				}
 			}
-			return cached, nil
+			return err
 		}
-		// Cache miss
-		if d.metrics != nil {
-			d.metrics.RecordCacheMiss()
+	}
+	d.applyEntry(entry)
+	d.lastChange = time.Now()
+	if d.unsaved.Add(1) >= d.autosaveMutations() && d.compactNow != nil {
+		select {
+		case d.compactNow <- struct{}{}:
+		default:
 		}
 	}
-	
-	d.logger.Log("DATABASE", fmt.Sprintf("Fetching user with ID: %s from persistent storage", id))
-	
-	// Simulate slower persistent database query
-	time.Sleep(100 * time.Millisecond)
-	
+	return nil
+}
+
+// autosaveMutations is how many unsaved mutations trigger an early snapshot
+func (d *PersistentDatabase) autosaveMutations() int64 {
+	if d.config.AutosaveMutations > 0 {
+		return int64(d.config.AutosaveMutations)
+	}
+	return defaultAutosaveMutations
+}
+
+// compact folds the journal into a fresh snapshot
+func (d *PersistentDatabase) compact() error {
+	// Readers may continue, but no mutation can be journaled mid-snapshot
 	d.mu.RLock()
-	name, ok := d.users[id]
+	defer d.mu.RUnlock()
+
+	return d.compactLocked()
+}
+
+// compactLocked writes a snapshot and truncates the journal; caller holds d.mu
+// Holding d.mu even for reading keeps mutations out, so the unsaved count
+// can be reset without losing any.
+func (d *PersistentDatabase) compactLocked() error {
+	if err := d.writeSnapshot(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	d.unsaved.Store(0)
+	if d.journal != nil {
+		return d.journal.Truncate()
+	}
+	return nil
+}
+
+// startCompaction autosaves on the configured interval, and early once
+// autosave_mutations changes are unsaved
+func (d *PersistentDatabase) startCompaction() {
+	interval := defaultCompactionInterval
+	if d.config.CompactionInterval > 0 {
+		interval = time.Duration(d.config.CompactionInterval) * time.Second
+	}
+
+	d.compactNow = make(chan struct{}, 1)
+	d.stopCompact = make(chan struct{})
+	d.compactDone = make(chan struct{})
+
+	go func() {
+		defer close(d.compactDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-d.compactNow:
+			case <-d.stopCompact:
+				return
+			}
+
+			pending := d.unsaved.Load()
+			if pending == 0 {
+				continue
+			}
+
+			if err := d.compact(); err != nil {
+				d.logger.Log("DATABASE", fmt.Sprintf("Error autosaving: %v", err))
+				continue
+			}
+			d.logger.Log("DATABASE", fmt.Sprintf("Autosaved %d changes into snapshot", pending))
+		}
+	}()
+}
+
+// stopCompaction stops autosaving and waits for a save in progress
+func (d *PersistentDatabase) stopCompaction() {
+	if d.stopCompact != nil {
+		close(d.stopCompact)
+		<-d.compactDone
+		d.stopCompact = nil
+	}
+}
+
+// Close saves data and shuts down the database
+// The journal and lock are released even if the final save fails; unsaved
+// changes are still in the journal and are replayed on the next start.
+func (d *PersistentDatabase) Close(ctx context.Context) error {
+	if d.stopEdits != nil {
+		d.stopEditWatch()
+		// Catch an edit made since the last poll before saving over it
+		if err := d.checkForEdits(); err != nil {
+			d.logger.Log("DATABASE", fmt.Sprintf("Error checking for external edits: %v", err))
+		}
+	}
+	// No autosave may touch the files once they are unlocked
+	d.stopCompaction()
+
+	if d.readOnly {
+		d.logger.Log("DATABASE", "Read-only persistent database closed")
+		return nil
+	}
+
+	var saveErr error
+	if pending := d.unsaved.Load(); pending > 0 {
+		d.logger.Log("DATABASE", fmt.Sprintf("Saving %d changes before closing persistent database...", pending))
+		if saveErr = d.compact(); saveErr != nil {
+			d.logger.Log("DATABASE", fmt.Sprintf("Error saving data: %v", saveErr))
+		}
+	}
+	if err := errors.Join(saveErr, d.closeFiles()); err != nil {
+		return err
+	}
+	d.logger.Log("DATABASE", "Persistent database closed successfully")
+	return nil
+}
+
+// closeFiles closes the journal, then lets other processes at the data file
+func (d *PersistentDatabase) closeFiles() error {
+	var errs []error
+	if d.journal != nil {
+		if err := d.journal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close journal: %w", err))
+		}
+		d.journal = nil
+	}
+	if err := d.releaseLock(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// releaseLock lets other processes open the data file again
+func (d *PersistentDatabase) releaseLock() error {
+	if d.lock == nil {
+		return nil
+	}
+	err := d.lock.release()
+	d.lock = nil
+	if err != nil {
+		return fmt.Errorf("failed to release data file lock: %w", err)
+	}
+	return nil
+}
+
+// GetUser retrieves a user by ID
+func (d *PersistentDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	// Simulate slower persistent database query, bounded by the configured timeout
+	queryCtx, cancel := queryContext(ctx, d.config)
+	defer cancel()
+	if err := simulateLatency(queryCtx, 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	user, ok := d.users[id]
 	d.mu.RUnlock()
-	
+
 	if ok {
-		// Store in cache if enabled
-		if d.cacheEnabled && len(d.cache) < d.config.CacheSize {
-			d.cache[id] = name
-			d.logger.Log("DATABASE", fmt.Sprintf("Cached user %s", id))
+		return user.Clone(), nil
+	}
+	return nil, ErrUserNotFound
+}
+
+// GetUsers retrieves several users for the cost of a single query
+func (d *PersistentDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	queryCtx, cancel := queryContext(ctx, d.config)
+	defer cancel()
+	if err := simulateLatency(queryCtx, 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	users := make(map[string]*User, len(ids))
+	for _, id := range ids {
+		if user, ok := d.users[id]; ok {
+			users[id] = user.Clone()
 		}
-		return name, nil
 	}
-	return "", fmt.Errorf("user not found")
-}
\ No newline at end of file
+	return users, nil
+}
+
+// ListUsers returns a copy of all stored users ordered by ID
+func (d *PersistentDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	users := make([]*User, 0, len(d.users))
+	for _, user := range d.users {
+		users = append(users, user.Clone())
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+// QueryUsers returns one page of users matching query
+func (d *PersistentDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	candidates := make([]*User, 0, len(d.users))
+	for _, user := range d.users {
+		candidates = append(candidates, user)
+	}
+	return queryUsers(candidates, query, d.cursors)
+}
+
+// CreateUser stores a new user, failing if the ID is already taken
+// Every mutation is journaled and synced to disk before it is applied
+func (d *PersistentDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.users[user.ID]; ok {
+		return nil, ErrUserExists
+	}
+	stored := stampCreate(user)
+	if err := d.recordLocked(journalEntry{Op: journalOpPut, ID: user.ID, User: stored}); err != nil {
+		return nil, err
+	}
+	d.events.publish(EventCreate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// UpdateUser replaces an existing user, keeping its creation time
+func (d *PersistentDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, ok := d.users[user.ID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if err := checkVersion(existing, user); err != nil {
+		return nil, err
+	}
+	stored := stampUpdate(existing, user)
+	if err := d.recordLocked(journalEntry{Op: journalOpPut, ID: user.ID, User: stored}); err != nil {
+		return nil, err
+	}
+	d.events.publish(EventUpdate, user.ID, stored)
+	return stored.Clone(), nil
+}
+
+// DeleteUser removes a user
+func (d *PersistentDatabase) DeleteUser(ctx context.Context, id string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	if err := d.recordLocked(journalEntry{Op: journalOpDelete, ID: id}); err != nil {
+		return err
+	}
+	d.events.publish(EventDelete, id, nil)
+	return nil
+}
+
+// Watch streams change events after the given sequence number
+func (d *PersistentDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return d.events.watch(ctx, after)
+}
+
+// putUser stores user verbatim, creating or replacing it
+func (d *PersistentDatabase) putUser(ctx context.Context, user *User) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.recordLocked(journalEntry{Op: journalOpPut, ID: user.ID, User: user.Clone()})
+}
@@ -0,0 +1,232 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentAutosave(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.AutosaveMutations = 5
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	journal := filepath.Join(config.Database.DataDir, dataFileName+".journal")
+
+	ctx := context.Background()
+	db := NewPersistentDatabase(logger, config, metrics)
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	journalSize := func() int64 {
+		info, err := os.Stat(journal)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err := db.CreateUser(ctx, NewUser(fmt.Sprintf("a%d", i), "autosave"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(4), db.unsaved.Load())
+	assert.Positive(t, journalSize())
+
+	// The fifth change crosses the threshold and the snapshot catches up
+	_, err := db.CreateUser(ctx, NewUser("a4", "autosave"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return db.unsaved.Load() == 0 && journalSize() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats := metrics.GetStats()
+	assert.Contains(t, stats, "Persistence:")
+	assert.Contains(t, stats, "Last Save:")
+}
+
+func TestPersistentFileLock(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	ctx := context.Background()
+
+	first := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, first.Initialize(ctx))
+
+	second := NewPersistentDatabase(logger, config, nil)
+	err := second.Initialize(ctx)
+	require.ErrorIs(t, err, ErrLocked)
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+
+	// Readers never write, so they don't need the lock
+	readOnly := *config
+	readOnly.Database.ReadOnly = true
+	reader := NewPersistentDatabase(logger, &readOnly, nil)
+	require.NoError(t, reader.Initialize(ctx))
+	require.NoError(t, reader.Close(ctx))
+
+	require.NoError(t, first.Close(ctx))
+	require.NoError(t, second.Initialize(ctx))
+	require.NoError(t, second.Close(ctx))
+}
+
+func TestPersistentInitializeFailure(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.EditCheckInterval = 10
+	logger := NewLogger(config)
+
+	// Initialize fails at its very end, after the journal is open
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := NewPersistentDatabase(logger, config, nil)
+	require.ErrorIs(t, failed.Initialize(ctx), context.Canceled)
+	assert.Nil(t, failed.journal)
+	assert.Nil(t, failed.stopCompact)
+	assert.Nil(t, failed.stopEdits)
+
+	// Nothing is left holding the files
+	db := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(context.Background()))
+	require.NoError(t, db.Close(context.Background()))
+}
+
+func TestPersistentExternalEdits(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.EditCheckInterval = 10
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	dataFile := filepath.Join(config.Database.DataDir, dataFileName)
+	ctx := context.Background()
+
+	persistent := NewPersistentDatabase(logger, config, metrics)
+	db := NewCachingDatabase(persistent, logger, config, metrics)
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	created, err := db.CreateUser(ctx, NewUser("edited", "before"))
+	require.NoError(t, err)
+	require.NoError(t, persistent.compact())
+	_, err = db.GetUser(ctx, "edited") // cached
+	require.NoError(t, err)
+
+	editFile := func(name string) {
+		users, err := db.ListUsers(ctx)
+		require.NoError(t, err)
+		byID := make(map[string]*User, len(users))
+		for _, user := range users {
+			byID[user.ID] = user
+		}
+		edited := *created
+		edited.Name = name
+		byID[edited.ID] = &edited
+		data, err := encodeDataFile(byID)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dataFile, data, 0644))
+	}
+
+	// The edit replaces the cached copy and gets a new version
+	editFile("by hand")
+	require.Eventually(t, func() bool {
+		user, err := db.GetUser(ctx, "edited")
+		return err == nil && user.Name == "by hand"
+	}, 2*time.Second, 10*time.Millisecond)
+	user, err := db.GetUser(ctx, "edited")
+	require.NoError(t, err)
+	assert.Greater(t, user.Version, created.Version)
+	assert.Contains(t, metrics.GetStats(), "External Edits Reloaded: 1")
+
+	// Under the memory policy unsaved changes win and are written over the edit
+	persistent.stopEditWatch()
+	persistent.config.EditConflictPolicy = EditPolicyMemory
+	_, err = db.CreateUser(ctx, NewUser("unsaved", "memory"))
+	require.NoError(t, err)
+	editFile("overwritten")
+	require.NoError(t, persistent.checkForEdits())
+
+	user, err = db.GetUser(ctx, "edited")
+	require.NoError(t, err)
+	assert.Equal(t, "by hand", user.Name)
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "unsaved")
+	assert.NotContains(t, string(data), "overwritten")
+}
+
+func TestPersistentStorageOptions(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.DataDir = filepath.Join(config.Database.DataDir, "nested", "dir")
+	config.Database.FileMode = "0640"
+	logger := NewLogger(config)
+	dataFile := filepath.Join(config.Database.DataDir, dataFileName)
+	ctx := context.Background()
+
+	db := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+	_, err := db.CreateUser(ctx, NewUser("s", "Storage"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+
+	info, err := os.Stat(dataFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// A data file more permissive than file_mode is tightened on open
+	require.NoError(t, os.Chmod(dataFile, 0666))
+	db = NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+	require.NoError(t, db.Close(ctx))
+	info, err = os.Stat(dataFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	invalid := *config
+	invalid.Database.FileMode = "0400"
+	assert.ErrorContains(t, NewPersistentDatabase(logger, &invalid, nil).Initialize(ctx), "owner needs read and write access")
+}
+
+func TestPersistentReadOnly(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	ctx := context.Background()
+
+	writer := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, writer.Initialize(ctx))
+	_, err := writer.CreateUser(ctx, NewUser("ro", "Read Only"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close(ctx))
+
+	// snapshotDir records every file's size and modification time
+	snapshotDir := func() map[string]string {
+		entries, err := os.ReadDir(config.Database.DataDir)
+		require.NoError(t, err)
+		files := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			files[entry.Name()] = fmt.Sprintf("%d@%s", info.Size(), info.ModTime())
+		}
+		return files
+	}
+	before := snapshotDir()
+
+	readOnly := *config
+	readOnly.Database.ReadOnly = true
+	db := NewPersistentDatabase(logger, &readOnly, nil)
+	require.NoError(t, db.Initialize(ctx))
+
+	user, err := db.GetUser(ctx, "ro")
+	require.NoError(t, err)
+	_, err = db.CreateUser(ctx, NewUser("new", "New"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	user.Name = "Changed"
+	_, err = db.UpdateUser(ctx, user)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, db.DeleteUser(ctx, "ro"), ErrReadOnly)
+	require.NoError(t, db.Close(ctx))
+
+	assert.Equal(t, before, snapshotDir())
+}
@@ -0,0 +1,177 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPoolExhausted is returned when no connection frees up within the wait timeout
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// connectionSlots holds one token per connection in use
+type connectionSlots chan struct{}
+
+// PooledDatabase wraps any Database and caps in-flight operations at
+// DatabaseConfig.MaxConnections, queueing callers until a slot frees up
+type PooledDatabase struct {
+	db          Database
+	logger      *Logger
+	metrics     *Metrics
+	slots       connectionSlots
+	waitTimeout time.Duration
+}
+
+// NewPooledDatabase wraps db with a connection limit taken from config
+// A non-positive MaxConnections leaves the database unlimited; a tenant's
+// database draws on the slots shared by all tenants
+func NewPooledDatabase(db Database, logger *Logger, config *Config, metrics *Metrics) *PooledDatabase {
+	p := &PooledDatabase{
+		db:          db,
+		logger:      logger,
+		metrics:     metrics,
+		slots:       config.Database.pool,
+		waitTimeout: time.Duration(config.Database.PoolWaitTimeout) * time.Millisecond,
+	}
+	if p.slots == nil && config.Database.MaxConnections > 0 {
+		p.slots = make(connectionSlots, config.Database.MaxConnections)
+	}
+	if metrics != nil {
+		metrics.SetPoolCapacity(config.Database.MaxConnections)
+	}
+	return p
+}
+
+// acquire blocks until a connection slot is free, the wait times out, or ctx is done
+func (p *PooledDatabase) acquire(ctx context.Context) (func(), error) {
+	if p.slots == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		// Pool is full - queue up, bounded by the wait timeout
+		var timeout <-chan time.Time
+		if p.waitTimeout > 0 {
+			timer := time.NewTimer(p.waitTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case p.slots <- struct{}{}:
+		case <-timeout:
+			p.logger.Log("DATABASE", fmt.Sprintf("Connection pool exhausted after waiting %v", p.waitTimeout))
+			if p.metrics != nil {
+				p.metrics.RecordPoolRejection()
+			}
+			return nil, ErrPoolExhausted
+		case <-ctx.Done():
+			if p.metrics != nil {
+				p.metrics.RecordPoolRejection()
+			}
+			return nil, fmt.Errorf("waiting for connection: %w", ctx.Err())
+		}
+	}
+
+	if p.metrics != nil {
+		p.metrics.RecordPoolAcquire(time.Since(start))
+	}
+	return func() {
+		<-p.slots
+		if p.metrics != nil {
+			p.metrics.RecordPoolRelease()
+		}
+	}, nil
+}
+
+// Initialize initializes the wrapped database
+func (p *PooledDatabase) Initialize(ctx context.Context) error {
+	if p.slots != nil {
+		p.logger.Log("DATABASE", fmt.Sprintf("Connection pool limited to %d connections", cap(p.slots)))
+	}
+	return p.db.Initialize(ctx)
+}
+
+// Close closes the wrapped database
+func (p *PooledDatabase) Close(ctx context.Context) error {
+	return p.db.Close(ctx)
+}
+
+// GetUser retrieves a user once a connection is available
+func (p *PooledDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.GetUser(ctx, id)
+}
+
+// GetUsers retrieves several users on a single connection
+func (p *PooledDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.GetUsers(ctx, ids)
+}
+
+// ListUsers lists users once a connection is available
+func (p *PooledDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.ListUsers(ctx)
+}
+
+// QueryUsers runs a user query once a connection is available
+func (p *PooledDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.QueryUsers(ctx, query)
+}
+
+// CreateUser creates a user once a connection is available
+func (p *PooledDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.CreateUser(ctx, user)
+}
+
+// UpdateUser updates a user once a connection is available
+func (p *PooledDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.db.UpdateUser(ctx, user)
+}
+
+// DeleteUser deletes a user once a connection is available
+func (p *PooledDatabase) DeleteUser(ctx context.Context, id string) error {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return p.db.DeleteUser(ctx, id)
+}
+
+// Watch subscribes without holding a connection for the life of the feed
+func (p *PooledDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return p.db.Watch(ctx, after)
+}
@@ -0,0 +1,542 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica roles reported in metrics
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+const (
+	// healthCheckUserID is looked up by health probes; not-found counts as healthy
+	healthCheckUserID = "__health_check__"
+	// replicationQueueSize bounds how far a replica may fall behind before it
+	// is marked for a full resync instead
+	replicationQueueSize = 1024
+	// defaultHealthCheckInterval applies when health_check_interval_ms is unset
+	defaultHealthCheckInterval = 5 * time.Second
+	// healthCheckTimeout bounds a single probe
+	healthCheckTimeout = 2 * time.Second
+)
+
+// replicationOp is a write applied on the primary that replicas must copy
+type replicationOp struct {
+	id       string
+	user     *User // nil for deletes
+	enqueued time.Time
+}
+
+// replicaMember is one backend in the replica set
+type replicaMember struct {
+	name         string
+	db           Database
+	queue        chan replicationOp
+	healthy      atomic.Bool
+	needsResync  atomic.Bool
+	pending      atomic.Int64 // queued or being applied
+	applyMu      sync.Mutex   // held while an op is applied, so a resync can wait it out
+	lag          atomic.Int64 // nanoseconds between enqueue and apply of the last op
+	failedChecks int          // consecutive failed health checks, owned by the health loop
+}
+
+// ReplicatedDatabase writes to a primary and spreads reads across replicas
+// Replicas are updated asynchronously, so reads may briefly trail writes;
+// reads marked with withPrimaryRead always go to the primary.
+// Health checks detect failed members; a failed primary is replaced by the
+// most up-to-date healthy replica, and recovered members are resynced.
+type ReplicatedDatabase struct {
+	logger   *Logger
+	config   *Config
+	metrics  *Metrics
+	members  []*replicaMember
+	interval time.Duration
+
+	mu      sync.RWMutex // guards primary
+	primary *replicaMember
+	writeMu sync.Mutex // keeps replication order identical to primary order
+	next    atomic.Uint64
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	// The replica set keeps its own feed, so watchers survive failover
+	events *eventHub
+}
+
+// NewReplicatedDatabase builds the primary and replicas listed in config.Database.Replication
+func NewReplicatedDatabase(logger *Logger, config *Config, metrics *Metrics) (*ReplicatedDatabase, error) {
+	replication := config.Database.Replication
+	if replication.Primary == "" {
+		return nil, fmt.Errorf("replication requires a primary backend")
+	}
+
+	primary, err := newMemberDatabase(replication.Primary, "primary", logger, config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	members := []Database{primary}
+	for i, kind := range replication.Replicas {
+		replica, err := newMemberDatabase(kind, fmt.Sprintf("replica-%d", i+1), logger, config, metrics)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, replica)
+	}
+	return newReplicatedDatabase(members, logger, config, metrics), nil
+}
+
+// newReplicatedDatabase wraps existing backends; members[0] starts as primary
+func newReplicatedDatabase(dbs []Database, logger *Logger, config *Config, metrics *Metrics) *ReplicatedDatabase {
+	r := &ReplicatedDatabase{
+		logger:   logger,
+		config:   config,
+		metrics:  metrics,
+		interval: defaultHealthCheckInterval,
+		events:   newEventHub(metrics),
+	}
+	if ms := config.Database.Replication.HealthCheckInterval; ms > 0 {
+		r.interval = time.Duration(ms) * time.Millisecond
+	}
+
+	for i, db := range dbs {
+		name := "primary"
+		if i > 0 {
+			name = fmt.Sprintf("replica-%d", i)
+		}
+		m := &replicaMember{name: name, db: db, queue: make(chan replicationOp, replicationQueueSize)}
+		m.healthy.Store(true)
+		r.members = append(r.members, m)
+	}
+	r.primary = r.members[0]
+	return r
+}
+
+// Initialize starts every member, brings replicas in line with the primary
+// and starts replication and health checking
+func (r *ReplicatedDatabase) Initialize(ctx context.Context) (err error) {
+	r.logger.Log("DATABASE", fmt.Sprintf("Initializing REPLICATED database with %d replicas", len(r.members)-1))
+
+	for i, m := range r.members {
+		if err := m.db.Initialize(ctx); err != nil {
+			// Don't leave the members already open holding their files
+			r.closeMembers(ctx, r.members[:i])
+			return fmt.Errorf("failed to initialize %s: %w", m.name, err)
+		}
+	}
+	defer func() {
+		if err != nil {
+			r.closeMembers(ctx, r.members)
+		}
+	}()
+
+	primary := r.currentPrimary()
+	existing, err := primary.db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	err = seedComposite(ctx, r.logger, r.config, len(existing) == 0, func(user *User) error {
+		return putUser(ctx, primary.db, user)
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range r.members[1:] {
+		if err := r.resync(ctx, m); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", m.name, err)
+		}
+	}
+
+	r.stop = make(chan struct{})
+	for _, m := range r.members {
+		r.wg.Add(1)
+		go r.replicate(m)
+	}
+	r.wg.Add(1)
+	go r.healthLoop()
+
+	r.publishStatus()
+	return nil
+}
+
+// Close stops background work and closes every member
+func (r *ReplicatedDatabase) Close(ctx context.Context) error {
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+		r.stop = nil
+	}
+	return r.closeMembers(ctx, r.members)
+}
+
+// closeMembers closes members, reporting every failure
+func (r *ReplicatedDatabase) closeMembers(ctx context.Context, members []*replicaMember) error {
+	var errs []error
+	for _, m := range members {
+		if err := m.db.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// currentPrimary returns the member currently accepting writes
+func (r *ReplicatedDatabase) currentPrimary() *replicaMember {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.primary
+}
+
+// readMember picks the next healthy, in-sync replica, or the primary if there is none
+func (r *ReplicatedDatabase) readMember() *replicaMember {
+	primary := r.currentPrimary()
+	n := uint64(len(r.members))
+	start := r.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		m := r.members[(start+i)%n]
+		if m != primary && m.healthy.Load() && !m.needsResync.Load() {
+			return m
+		}
+	}
+	return primary
+}
+
+// read runs a read on a replica, falling back to the primary if the replica fails
+func (r *ReplicatedDatabase) read(ctx context.Context, call func(Database) error) error {
+	if primaryRead(ctx) {
+		return call(r.currentPrimary().db)
+	}
+	m := r.readMember()
+	err := call(m.db)
+	if err == nil || isPermanent(err) || m == r.currentPrimary() {
+		return err
+	}
+
+	r.logger.Log("DATABASE", fmt.Sprintf("Read from %s failed, falling back to primary: %v", m.name, err))
+	m.healthy.Store(false)
+	return call(r.currentPrimary().db)
+}
+
+// GetUser reads a user from a replica
+func (r *ReplicatedDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	var user *User
+	err := r.read(ctx, func(db Database) (err error) {
+		user, err = db.GetUser(ctx, id)
+		return err
+	})
+	return user, err
+}
+
+// GetUsers reads several users from a replica
+func (r *ReplicatedDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	var users map[string]*User
+	err := r.read(ctx, func(db Database) (err error) {
+		users, err = db.GetUsers(ctx, ids)
+		return err
+	})
+	return users, err
+}
+
+// ListUsers lists users from a replica
+func (r *ReplicatedDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	var users []*User
+	err := r.read(ctx, func(db Database) (err error) {
+		users, err = db.ListUsers(ctx)
+		return err
+	})
+	return users, err
+}
+
+// QueryUsers runs a user query on a replica
+func (r *ReplicatedDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	var page *UserPage
+	err := r.read(ctx, func(db Database) (err error) {
+		page, err = db.QueryUsers(ctx, query)
+		return err
+	})
+	return page, err
+}
+
+// write applies a mutation on the primary, queues it for every replica and
+// publishes it on the replica set's change feed
+func (r *ReplicatedDatabase) write(ctx context.Context, eventType, id string, call func(Database) (*User, error)) (*User, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	primary := r.currentPrimary()
+	user, err := call(primary.db)
+	if err != nil {
+		return nil, err
+	}
+
+	op := replicationOp{id: id, enqueued: time.Now()}
+	if eventType != EventDelete {
+		op.user = user.Clone()
+	}
+	for _, m := range r.members {
+		if m == primary || m.needsResync.Load() {
+			continue
+		}
+		select {
+		case m.queue <- op:
+			m.pending.Add(1)
+		default:
+			// Too far behind to catch up op by op
+			r.logger.Log("DATABASE", fmt.Sprintf("Replication queue for %s is full, scheduling resync", m.name))
+			m.needsResync.Store(true)
+		}
+	}
+	r.events.publish(eventType, id, op.user)
+	return user, nil
+}
+
+// CreateUser creates a user on the primary
+func (r *ReplicatedDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	return r.write(ctx, EventCreate, user.ID, func(db Database) (*User, error) {
+		return db.CreateUser(ctx, user)
+	})
+}
+
+// UpdateUser updates a user on the primary
+func (r *ReplicatedDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	return r.write(ctx, EventUpdate, user.ID, func(db Database) (*User, error) {
+		return db.UpdateUser(ctx, user)
+	})
+}
+
+// DeleteUser deletes a user on the primary
+func (r *ReplicatedDatabase) DeleteUser(ctx context.Context, id string) error {
+	_, err := r.write(ctx, EventDelete, id, func(db Database) (*User, error) {
+		return nil, db.DeleteUser(ctx, id)
+	})
+	return err
+}
+
+// Watch streams the replica set's change events after the given sequence number
+func (r *ReplicatedDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return r.events.watch(ctx, after)
+}
+
+// replicate applies queued writes to m until Close
+func (r *ReplicatedDatabase) replicate(m *replicaMember) {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case op := <-m.queue:
+			r.apply(m, op)
+		}
+	}
+}
+
+// apply copies one queued write onto m
+// The op stays counted as pending until it has landed, so failover never
+// mistakes a replica with a write in flight for one that is caught up.
+func (r *ReplicatedDatabase) apply(m *replicaMember, op replicationOp) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	defer m.pending.Add(-1)
+
+	if m.needsResync.Load() {
+		// A resync will copy the final state anyway
+		return
+	}
+
+	var err error
+	if op.user != nil {
+		err = putUser(context.Background(), m.db, op.user)
+	} else if err = m.db.DeleteUser(context.Background(), op.id); errors.Is(err, ErrUserNotFound) {
+		err = nil
+	}
+	if err != nil {
+		r.logger.Log("DATABASE", fmt.Sprintf("Replication to %s failed, scheduling resync: %v", m.name, err))
+		m.needsResync.Store(true)
+		return
+	}
+	m.lag.Store(int64(time.Since(op.enqueued)))
+}
+
+// resync copies the primary's full dataset onto m and removes anything extra
+func (r *ReplicatedDatabase) resync(ctx context.Context, m *replicaMember) error {
+	// Block writes so nothing slips between the copy and re-enabling replication
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	// Anything still queued is superseded by the copy; an op already being
+	// applied must land before it, not after
+	m.needsResync.Store(true)
+	for len(m.queue) > 0 {
+		<-m.queue
+		m.pending.Add(-1)
+	}
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	primary := r.currentPrimary()
+	source, err := primary.db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	existing, err := m.db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(source))
+	for _, user := range source {
+		keep[user.ID] = true
+		if err := putUser(ctx, m.db, user); err != nil {
+			return err
+		}
+	}
+	for _, user := range existing {
+		if !keep[user.ID] {
+			if err := m.db.DeleteUser(ctx, user.ID); err != nil && !errors.Is(err, ErrUserNotFound) {
+				return err
+			}
+		}
+	}
+
+	m.needsResync.Store(false)
+	m.lag.Store(0)
+	r.logger.Log("DATABASE", fmt.Sprintf("Resynced %s with %d users from %s", m.name, len(source), primary.name))
+	return nil
+}
+
+// healthLoop probes every member on an interval
+func (r *ReplicatedDatabase) healthLoop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.checkHealth()
+			r.publishStatus()
+		}
+	}
+}
+
+// probe reports whether m answers a lookup in time
+func (r *ReplicatedDatabase) probe(m *replicaMember) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	_, err := m.db.GetUser(ctx, healthCheckUserID)
+	return err == nil || errors.Is(err, ErrUserNotFound)
+}
+
+// checkHealth updates member health, fails over a dead primary and resyncs recovered members
+func (r *ReplicatedDatabase) checkHealth() {
+	threshold := r.config.Database.Replication.FailoverThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	for _, m := range r.members {
+		if r.probe(m) {
+			m.failedChecks = 0
+			if !m.healthy.Load() {
+				r.logger.Log("DATABASE", fmt.Sprintf("Member %s recovered", m.name))
+				if m != r.currentPrimary() {
+					m.needsResync.Store(true)
+				}
+				m.healthy.Store(true)
+			}
+			continue
+		}
+
+		m.failedChecks++
+		if m.healthy.Load() {
+			r.logger.Log("DATABASE", fmt.Sprintf("Member %s failed health check", m.name))
+			m.healthy.Store(false)
+		}
+		if m == r.currentPrimary() && m.failedChecks >= threshold {
+			r.failover()
+		}
+	}
+
+	for _, m := range r.members {
+		if m != r.currentPrimary() && m.healthy.Load() && m.needsResync.Load() {
+			if err := r.resync(context.Background(), m); err != nil {
+				r.logger.Log("DATABASE", fmt.Sprintf("Resync of %s failed: %v", m.name, err))
+			}
+		}
+	}
+}
+
+// failover promotes the healthy replica with the fewest pending writes
+func (r *ReplicatedDatabase) failover() {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	old := r.currentPrimary()
+	var candidate *replicaMember
+	for _, m := range r.members {
+		if m == old || !m.healthy.Load() || m.needsResync.Load() {
+			continue
+		}
+		if candidate == nil || m.pending.Load() < candidate.pending.Load() {
+			candidate = m
+		}
+	}
+	if candidate == nil {
+		r.logger.Log("DATABASE", "Primary is down and no healthy replica is available for failover")
+		return
+	}
+
+	// Let the candidate apply everything the old primary acknowledged; writes
+	// are blocked, so nothing new is queued meanwhile
+	deadline := time.Now().Add(r.interval)
+	for candidate.pending.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if pending := candidate.pending.Load(); pending > 0 {
+		// Promoting it now would let those writes land after newer ones
+		r.logger.Log("DATABASE", fmt.Sprintf("Failover: %s still has %d pending writes, scheduling resync instead of promoting it",
+			candidate.name, pending))
+		candidate.needsResync.Store(true)
+		return
+	}
+
+	r.mu.Lock()
+	r.primary = candidate
+	r.mu.Unlock()
+
+	// The old primary rejoins as a replica once it recovers, after a full resync
+	old.needsResync.Store(true)
+	r.logger.Log("DATABASE", fmt.Sprintf("Failover: promoted %s to primary, demoted %s", candidate.name, old.name))
+	if r.metrics != nil {
+		r.metrics.RecordFailover()
+	}
+}
+
+// publishStatus reports role, health and lag of every member to metrics
+func (r *ReplicatedDatabase) publishStatus() {
+	if r.metrics == nil {
+		return
+	}
+	primary := r.currentPrimary()
+	for _, m := range r.members {
+		role := roleReplica
+		if m == primary {
+			role = rolePrimary
+		}
+		r.metrics.SetReplicaStatus(m.name, ReplicaStatus{
+			Role:       role,
+			Healthy:    m.healthy.Load(),
+			Resyncing:  m.needsResync.Load(),
+			PendingOps: m.pending.Load(),
+			Lag:        time.Duration(m.lag.Load()),
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downableDatabase fails every call while down is set
+type downableDatabase struct {
+	Database
+	down atomic.Bool
+}
+
+var errMemberDown = errors.New("member down")
+
+func (d *downableDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	if d.down.Load() {
+		return nil, errMemberDown
+	}
+	return d.Database.GetUser(ctx, id)
+}
+
+func (d *downableDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	if d.down.Load() {
+		return nil, errMemberDown
+	}
+	return d.Database.CreateUser(ctx, user)
+}
+
+func TestReplicatedDatabaseFailover(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	config.Database.Replication = ReplicationConfig{HealthCheckInterval: 20, FailoverThreshold: 2}
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	primary := &downableDatabase{Database: NewInMemoryDatabase(logger, config, metrics)}
+	replica := &downableDatabase{Database: NewInMemoryDatabase(logger, config, metrics)}
+	db := newReplicatedDatabase([]Database{primary, replica}, logger, config, metrics)
+
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	// Writes reach the replica asynchronously
+	_, err := db.CreateUser(ctx, NewUser("42", "Dana"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := replica.GetUser(ctx, "42")
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+
+	// Reads survive a failed replica by falling back to the primary
+	replica.down.Store(true)
+	user, err := db.GetUser(ctx, "42")
+	require.NoError(t, err)
+	assert.Equal(t, "Dana", user.Name)
+	replica.down.Store(false)
+
+	// A dead primary is replaced by the replica
+	primary.down.Store(true)
+	require.Eventually(t, func() bool {
+		return db.currentPrimary().db == replica
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, err = db.CreateUser(ctx, NewUser("43", "Eve"))
+	require.NoError(t, err)
+
+	// The old primary is resynced once it comes back
+	primary.down.Store(false)
+	require.Eventually(t, func() bool {
+		_, err := primary.GetUser(ctx, "43")
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats := metrics.GetStats()
+	assert.Contains(t, stats, "Failovers: 1")
+	assert.Contains(t, stats, "replica-1: primary")
+}
+
+// lifecycleDatabase records Close and can fail Initialize
+type lifecycleDatabase struct {
+	Database
+	initErr error
+	closed  atomic.Bool
+}
+
+func (d *lifecycleDatabase) Initialize(ctx context.Context) error {
+	if d.initErr != nil {
+		return d.initErr
+	}
+	return d.Database.Initialize(ctx)
+}
+
+func (d *lifecycleDatabase) Close(ctx context.Context) error {
+	d.closed.Store(true)
+	return d.Database.Close(ctx)
+}
+
+func TestReplicatedDatabaseInitializeFailure(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+
+	primary := &lifecycleDatabase{Database: NewInMemoryDatabase(logger, config, nil)}
+	replica := &lifecycleDatabase{Database: NewInMemoryDatabase(logger, config, nil), initErr: errMemberDown}
+	db := newReplicatedDatabase([]Database{primary, replica}, logger, config, nil)
+
+	err := db.Initialize(context.Background())
+	assert.ErrorIs(t, err, errMemberDown)
+	assert.True(t, primary.closed.Load())
+	assert.False(t, replica.closed.Load())
+}
+
+func TestReplicatedDatabasePrimaryReads(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+
+	primary := NewInMemoryDatabase(logger, config, nil)
+	replica := NewInMemoryDatabase(logger, config, nil)
+	db := newReplicatedDatabase([]Database{primary, replica}, logger, config, nil)
+
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	// A write the replica hasn't seen yet
+	_, err := primary.CreateUser(ctx, NewUser("42", "Dana"))
+	require.NoError(t, err)
+
+	_, err = db.GetUser(ctx, "42")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	user, err := db.GetUser(withPrimaryRead(ctx), "42")
+	require.NoError(t, err)
+	assert.Equal(t, "Dana", user.Name)
+}
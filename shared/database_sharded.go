@@ -0,0 +1,543 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultVirtualNodes applies when virtual_nodes is unset
+// More points per shard evens out the share of IDs each shard owns
+const defaultVirtualNodes = 100
+
+// shardMember is one child backend of a sharded database
+type shardMember struct {
+	name string
+	db   Database
+	size atomic.Int64 // users stored on this shard
+}
+
+// hashRing maps IDs to shards by consistent hashing
+// Each shard owns several points on the ring, and an ID belongs to the first
+// point at or after its own hash. Adding a shard only moves the IDs that land
+// on the new shard's points.
+type hashRing struct {
+	points []uint64
+	owners map[uint64]*shardMember
+}
+
+// ringHash places a key on the ring
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// newHashRing builds a ring with virtualNodes points per shard
+func newHashRing(shards []*shardMember, virtualNodes int) *hashRing {
+	r := &hashRing{owners: make(map[uint64]*shardMember, len(shards)*virtualNodes)}
+	for _, shard := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			point := ringHash(shard.name + "#" + strconv.Itoa(i))
+			r.owners[point] = shard
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the shard responsible for id
+func (r *hashRing) owner(id string) *shardMember {
+	h := ringHash(id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// ShardedDatabase partitions users across several backends by consistent hash of ID
+// Each shard only holds and rewrites its own slice of the user set. Shards can
+// be added while serving: users are moved to their new owner in the background,
+// and lookups check the previous owner until the move is complete.
+type ShardedDatabase struct {
+	logger       *Logger
+	config       *Config
+	metrics      *Metrics
+	virtualNodes int
+	cursors      *cursorCodec
+	events       *eventHub // one feed across all shards; moves are not changes
+
+	// ringMu is held for reading from routing an operation until it is done,
+	// and exclusively while the ring changes, so no write lands on a shard the
+	// ring moved away from after the rebalance has already passed it
+	ringMu sync.RWMutex
+
+	mu       sync.RWMutex // guards shards, ring and previous
+	shards   []*shardMember
+	ring     *hashRing
+	previous *hashRing // ring before the rebalance in progress, nil otherwise
+
+	// moveMu is held exclusively while a user changes shards, so readers never
+	// see it on neither or both
+	moveMu      sync.RWMutex
+	rebalanceMu sync.Mutex
+}
+
+// NewShardedDatabase builds one shard per backend listed in config.Database.Sharding
+func NewShardedDatabase(logger *Logger, config *Config, metrics *Metrics) (*ShardedDatabase, error) {
+	kinds := config.Database.Sharding.Shards
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("sharding requires at least one shard")
+	}
+
+	dbs := make([]Database, 0, len(kinds))
+	for i, kind := range kinds {
+		db, err := newMemberDatabase(kind, shardName(i), logger, config, metrics)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return newShardedDatabase(dbs, logger, config, metrics), nil
+}
+
+// newShardedDatabase wraps existing backends as shards in order
+func newShardedDatabase(dbs []Database, logger *Logger, config *Config, metrics *Metrics) *ShardedDatabase {
+	s := &ShardedDatabase{
+		logger:       logger,
+		config:       config,
+		metrics:      metrics,
+		virtualNodes: config.Database.Sharding.VirtualNodes,
+		cursors:      newCursorCodec(&config.Database),
+		events:       newEventHub(metrics),
+	}
+	if s.virtualNodes <= 0 {
+		s.virtualNodes = defaultVirtualNodes
+	}
+	for i, db := range dbs {
+		s.shards = append(s.shards, &shardMember{name: shardName(i), db: db})
+	}
+	s.ring = newHashRing(s.shards, s.virtualNodes)
+	return s
+}
+
+// shardName names the i-th shard; it also names the shard's data directory
+// and its points on the ring, so it must stay stable across restarts
+func shardName(i int) string {
+	return fmt.Sprintf("shard-%d", i)
+}
+
+// Initialize starts every shard and moves any user stored on the wrong shard
+// to its owner, which also picks up shards added to the configuration
+func (s *ShardedDatabase) Initialize(ctx context.Context) (err error) {
+	s.logger.Log("DATABASE", fmt.Sprintf("Initializing SHARDED database with %d shards", len(s.shards)))
+
+	opened := 0
+	defer func() {
+		if err != nil {
+			// Don't leave the shards already open holding their files
+			s.closeShards(ctx, s.shards[:opened])
+		}
+	}()
+	for _, shard := range s.shards {
+		if err := shard.db.Initialize(ctx); err != nil {
+			return fmt.Errorf("failed to initialize %s: %w", shard.name, err)
+		}
+		opened++
+		users, err := shard.db.ListUsers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to count %s: %w", shard.name, err)
+		}
+		shard.size.Store(int64(len(users)))
+	}
+
+	if err := s.rebalance(ctx, s.snapshot()); err != nil {
+		return err
+	}
+
+	total := int64(0)
+	for _, size := range s.ShardSizes() {
+		total += size
+	}
+	err = seedComposite(ctx, s.logger, s.config, total == 0, func(user *User) error {
+		owner, _ := s.route(user.ID)
+		if err := putUser(ctx, owner.db, user); err != nil {
+			return err
+		}
+		owner.size.Add(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.publishSizes()
+	return nil
+}
+
+// Close closes every shard
+func (s *ShardedDatabase) Close(ctx context.Context) error {
+	return s.closeShards(ctx, s.snapshot())
+}
+
+// closeShards closes shards, reporting every failure
+func (s *ShardedDatabase) closeShards(ctx context.Context, shards []*shardMember) error {
+	var errs []error
+	for _, shard := range shards {
+		if err := shard.db.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", shard.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddShard creates a backend of the given type, adds it to the ring and moves
+// its share of users onto it while the database keeps serving requests.
+// Add the same type to sharding.shards in the configuration to keep the shard
+// after a restart.
+func (s *ShardedDatabase) AddShard(ctx context.Context, kind string) error {
+	s.mu.RLock()
+	name := shardName(len(s.shards))
+	s.mu.RUnlock()
+
+	db, err := newMemberDatabase(kind, name, s.logger, s.config, s.metrics)
+	if err != nil {
+		return err
+	}
+	return s.addShard(ctx, db)
+}
+
+// addShard joins an existing backend to the ring and rebalances onto it
+func (s *ShardedDatabase) addShard(ctx context.Context, db Database) error {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+
+	if err := db.Initialize(ctx); err != nil {
+		return err
+	}
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.ringMu.Lock()
+	s.mu.Lock()
+	shard := &shardMember{name: shardName(len(s.shards)), db: db}
+	shard.size.Store(int64(len(users)))
+	s.shards = append(append([]*shardMember(nil), s.shards...), shard)
+	s.previous = s.ring
+	s.ring = newHashRing(s.shards, s.virtualNodes)
+	s.mu.Unlock()
+	s.ringMu.Unlock()
+
+	s.logger.Log("DATABASE", fmt.Sprintf("Added %s, rebalancing users", shard.name))
+	// The new shard goes through the same pass in case it came with seed data
+	err = s.rebalanceLocked(ctx, s.snapshot())
+
+	s.ringMu.Lock()
+	s.mu.Lock()
+	s.previous = nil
+	s.mu.Unlock()
+	s.ringMu.Unlock()
+	s.publishSizes()
+	return err
+}
+
+// snapshot returns the current shard list
+func (s *ShardedDatabase) snapshot() []*shardMember {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards
+}
+
+// route returns the owner of id and, during a rebalance, its previous owner
+func (s *ShardedDatabase) route(id string) (owner, previous *shardMember) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner = s.ring.owner(id)
+	if s.previous != nil {
+		previous = s.previous.owner(id)
+	}
+	return owner, previous
+}
+
+// rebalance moves users on sources that belong to another shard
+func (s *ShardedDatabase) rebalance(ctx context.Context, sources []*shardMember) error {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	return s.rebalanceLocked(ctx, sources)
+}
+
+func (s *ShardedDatabase) rebalanceLocked(ctx context.Context, sources []*shardMember) error {
+	moved := 0
+	for _, shard := range sources {
+		users, err := shard.db.ListUsers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", shard.name, err)
+		}
+		for _, user := range users {
+			owner, _ := s.route(user.ID)
+			if owner == shard {
+				continue
+			}
+			s.moveMu.Lock()
+			err := s.moveUser(ctx, user.ID, shard, owner)
+			s.moveMu.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to move user %s from %s to %s: %w", user.ID, shard.name, owner.name, err)
+			}
+			moved++
+		}
+	}
+	if moved > 0 {
+		s.logger.Log("DATABASE", fmt.Sprintf("Rebalanced %d users across %d shards", moved, len(s.snapshot())))
+	}
+	return nil
+}
+
+// moveUser copies id from one shard to another and removes the original
+// If the destination already holds the user, its copy wins: every write since
+// the ring changed went there, and a duplicate elsewhere is only a leftover
+// seed or an interrupted move. The caller must hold moveMu exclusively.
+func (s *ShardedDatabase) moveUser(ctx context.Context, id string, from, to *shardMember) error {
+	user, err := from.db.GetUser(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		// Already moved or deleted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = to.db.GetUser(ctx, id)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		if err := putUser(ctx, to.db, user); err != nil {
+			return err
+		}
+		to.size.Add(1)
+	case err != nil:
+		return err
+	}
+
+	if err := from.db.DeleteUser(ctx, id); err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	from.size.Add(-1)
+	return nil
+}
+
+// GetUser reads a user from its shard
+func (s *ShardedDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+
+	owner, previous := s.route(id)
+	if previous == nil || previous == owner {
+		return owner.db.GetUser(ctx, id)
+	}
+
+	// Mid-rebalance the user may not have moved yet
+	s.moveMu.RLock()
+	defer s.moveMu.RUnlock()
+	user, err := owner.db.GetUser(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		return previous.db.GetUser(ctx, id)
+	}
+	return user, err
+}
+
+// GetUsers looks up each shard's IDs in parallel, one batch per shard
+func (s *ShardedDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+	s.moveMu.RLock()
+	defer s.moveMu.RUnlock()
+
+	// Mid-rebalance, IDs missing from their owner are retried on the previous owner
+	batches := make(map[*shardMember][]string)
+	fallback := make(map[string]*shardMember)
+	for _, id := range ids {
+		owner, previous := s.route(id)
+		batches[owner] = append(batches[owner], id)
+		if previous != nil && previous != owner {
+			fallback[id] = previous
+		}
+	}
+
+	users, err := s.getBatches(ctx, batches)
+	if err != nil || len(fallback) == 0 {
+		return users, err
+	}
+
+	retries := make(map[*shardMember][]string)
+	for id, previous := range fallback {
+		if _, ok := users[id]; !ok {
+			retries[previous] = append(retries[previous], id)
+		}
+	}
+	moved, err := s.getBatches(ctx, retries)
+	if err != nil {
+		return nil, err
+	}
+	for id, user := range moved {
+		users[id] = user
+	}
+	return users, nil
+}
+
+// getBatches runs one GetUsers per shard concurrently and merges the results
+func (s *ShardedDatabase) getBatches(ctx context.Context, batches map[*shardMember][]string) (map[string]*User, error) {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		errs  []error
+		users = make(map[string]*User)
+	)
+	for shard, ids := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			part, err := shard.db.GetUsers(ctx, ids)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", shard.name, err))
+				return
+			}
+			for id, user := range part {
+				users[id] = user
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ListUsers merges the users of every shard ordered by ID
+func (s *ShardedDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	s.moveMu.RLock()
+	defer s.moveMu.RUnlock()
+
+	users := make([]*User, 0)
+	for _, shard := range s.snapshot() {
+		part, err := shard.db.ListUsers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", shard.name, err)
+		}
+		users = append(users, part...)
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+// QueryUsers runs the query on every shard and merges the pages
+// Each shard returns up to a full page, so the merged page is exact
+func (s *ShardedDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	s.moveMu.RLock()
+	defer s.moveMu.RUnlock()
+
+	var pages []*UserPage
+	for _, shard := range s.snapshot() {
+		page, err := shard.db.QueryUsers(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", shard.name, err)
+		}
+		pages = append(pages, page)
+	}
+	return mergePages(pages, query, s.cursors)
+}
+
+// write runs a mutation on the owner of id, first moving the user there if a
+// rebalance has not reached it yet
+func (s *ShardedDatabase) write(ctx context.Context, id string, call func(*shardMember) error) error {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+
+	owner, previous := s.route(id)
+	if previous != nil && previous != owner {
+		s.moveMu.Lock()
+		defer s.moveMu.Unlock()
+		if err := s.moveUser(ctx, id, previous, owner); err != nil {
+			return err
+		}
+	}
+	return call(owner)
+}
+
+// CreateUser creates a user on its shard
+func (s *ShardedDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	var created *User
+	err := s.write(ctx, user.ID, func(shard *shardMember) (err error) {
+		if created, err = shard.db.CreateUser(ctx, user); err == nil {
+			shard.size.Add(1)
+			s.publishSize(shard)
+			s.events.publish(EventCreate, created.ID, created)
+		}
+		return err
+	})
+	return created, err
+}
+
+// UpdateUser updates a user on its shard
+func (s *ShardedDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	var updated *User
+	err := s.write(ctx, user.ID, func(shard *shardMember) (err error) {
+		if updated, err = shard.db.UpdateUser(ctx, user); err == nil {
+			s.events.publish(EventUpdate, updated.ID, updated)
+		}
+		return err
+	})
+	return updated, err
+}
+
+// DeleteUser deletes a user from its shard
+func (s *ShardedDatabase) DeleteUser(ctx context.Context, id string) error {
+	return s.write(ctx, id, func(shard *shardMember) error {
+		if err := shard.db.DeleteUser(ctx, id); err != nil {
+			return err
+		}
+		shard.size.Add(-1)
+		s.publishSize(shard)
+		s.events.publish(EventDelete, id, nil)
+		return nil
+	})
+}
+
+// Watch streams change events from every shard after the given sequence number
+func (s *ShardedDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	return s.events.watch(ctx, after)
+}
+
+// ShardSizes returns the number of users on each shard
+func (s *ShardedDatabase) ShardSizes() map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, shard := range s.snapshot() {
+		sizes[shard.name] = shard.size.Load()
+	}
+	return sizes
+}
+
+// publishSize reports the size of one shard to metrics
+func (s *ShardedDatabase) publishSize(shard *shardMember) {
+	if s.metrics != nil {
+		s.metrics.SetShardSize(shard.name, shard.size.Load())
+	}
+}
+
+// publishSizes reports the size of every shard to metrics
+func (s *ShardedDatabase) publishSizes() {
+	for _, shard := range s.snapshot() {
+		s.publishSize(shard)
+	}
+}
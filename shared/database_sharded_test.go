@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedDatabaseRebalance(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	config.Database.Sharding.VirtualNodes = 50
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	// Every in-memory shard seeds the same users; Initialize keeps one copy each
+	shards := []Database{
+		NewInMemoryDatabase(logger, config, metrics),
+		NewInMemoryDatabase(logger, config, metrics),
+		NewInMemoryDatabase(logger, config, metrics),
+	}
+	db := newShardedDatabase(shards, logger, config, metrics)
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	for i := 0; i < 60; i++ {
+		_, err := db.CreateUser(ctx, NewUser(fmt.Sprintf("user-%d", i), "User"))
+		require.NoError(t, err)
+	}
+	users, err := db.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 63)
+
+	// Reads keep working while a fourth shard takes over its share
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := db.GetUser(ctx, fmt.Sprintf("user-%d", i%60))
+			assert.NoError(t, err)
+		}
+	}()
+	require.NoError(t, db.addShard(ctx, NewInMemoryDatabase(logger, config, metrics)))
+	close(stop)
+	wg.Wait()
+
+	// Every user lives on exactly its owner
+	total := int64(0)
+	for _, shard := range db.snapshot() {
+		part, err := shard.db.ListUsers(ctx)
+		require.NoError(t, err)
+		assert.Len(t, part, int(shard.size.Load()), shard.name)
+		for _, user := range part {
+			owner, _ := db.route(user.ID)
+			assert.Equal(t, shard.name, owner.name, user.ID)
+		}
+		total += shard.size.Load()
+	}
+	assert.Equal(t, int64(63), total)
+	assert.Greater(t, db.ShardSizes()["shard-3"], int64(0))
+	assert.Contains(t, metrics.GetStats(), "shard-3:")
+}
+
+// slowCreateDatabase holds every create for a while before it lands
+type slowCreateDatabase struct {
+	Database
+}
+
+func (d *slowCreateDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	time.Sleep(200 * time.Millisecond)
+	return d.Database.CreateUser(ctx, user)
+}
+
+func TestShardedDatabaseWritesDuringAddShard(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	config.Database.StartEmpty = true
+	config.Database.Sharding.VirtualNodes = 50
+	logger := NewLogger(config)
+
+	shards := []Database{
+		&slowCreateDatabase{NewInMemoryDatabase(logger, config, nil)},
+		&slowCreateDatabase{NewInMemoryDatabase(logger, config, nil)},
+	}
+	db := newShardedDatabase(shards, logger, config, nil)
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	// Creates still in flight when the ring changes must not land on a shard
+	// the rebalance has already passed
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids []string
+	)
+	stop := make(chan struct{})
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := fmt.Sprintf("user-%d-%d", w, i)
+				_, err := db.CreateUser(ctx, NewUser(id, "User"))
+				assert.NoError(t, err)
+				mu.Lock()
+				ids = append(ids, id)
+				mu.Unlock()
+			}
+		}()
+	}
+	require.NoError(t, db.addShard(ctx, NewInMemoryDatabase(logger, config, nil)))
+	close(stop)
+	wg.Wait()
+
+	for _, id := range ids {
+		owner, _ := db.route(id)
+		_, err := owner.db.GetUser(ctx, id)
+		assert.NoError(t, err, id)
+	}
+}
+
+func TestShardedDatabaseInitializeFailure(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	ctx := context.Background()
+
+	// The first shard opens and locks its files before the second one fails
+	open := func(failing bool) (*ShardedDatabase, error) {
+		second := &lifecycleDatabase{Database: NewInMemoryDatabase(logger, config, nil)}
+		if failing {
+			second.initErr = errMemberDown
+		}
+		db := newShardedDatabase([]Database{NewPersistentDatabase(logger, config, nil), second}, logger, config, nil)
+		return db, db.Initialize(ctx)
+	}
+	_, err := open(true)
+	require.ErrorIs(t, err, errMemberDown)
+
+	// A retry in the same process finds the files free again
+	db, err := open(false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+}
@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Errors returned when reading encrypted files
+var (
+	ErrWrongKey  = errors.New("encrypted with a key that is not configured")
+	ErrTampered  = errors.New("failed authentication: modified or corrupted")
+	ErrEncrypted = errors.New("encrypted but no encryption key is configured")
+)
+
+// sealedCipher is the only algorithm written in sealed files
+const sealedCipher = "aes-256-gcm"
+
+// What a sealed payload is, bound into its authentication tag so that a
+// journal entry can't be passed off as a snapshot or vice versa
+const (
+	sealSnapshot = "snapshot"
+	sealJournal  = "journal"
+	sealAudit    = "audit"
+)
+
+// sealedFile is the JSON envelope of encrypted content
+type sealedFile struct {
+	Cipher string `json:"cipher"`
+	KeyID  string `json:"key_id"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// encryptionKey is one AES-256 key and its fingerprint
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// fileCipher seals data with the current key and opens data sealed with the
+// current or any previous key. A nil *fileCipher leaves data in plaintext.
+type fileCipher struct {
+	current  *encryptionKey
+	previous map[string]*encryptionKey
+	migrate  bool // plaintext is accepted so it can be encrypted in place
+}
+
+// newFileCipher loads the keys named in config, or returns nil when
+// encryption is not configured
+func newFileCipher(config *EncryptionConfig) (*fileCipher, error) {
+	if config.KeyEnv == "" && config.KeyFile == "" {
+		if len(config.PreviousKeys) > 0 {
+			return nil, errors.New("encryption previous_keys need a current key_env or key_file")
+		}
+		return nil, nil
+	}
+	if config.KeyEnv != "" && config.KeyFile != "" {
+		return nil, errors.New("encryption needs either key_env or key_file, not both")
+	}
+
+	ref := "file:" + config.KeyFile
+	if config.KeyEnv != "" {
+		ref = "env:" + config.KeyEnv
+	}
+	current, err := loadEncryptionKey(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCipher{current: current, previous: make(map[string]*encryptionKey), migrate: config.MigratePlaintext}
+	for _, ref := range config.PreviousKeys {
+		if !strings.HasPrefix(ref, "env:") {
+			ref = "file:" + ref
+		}
+		key, err := loadEncryptionKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		c.previous[key.id] = key
+	}
+	return c, nil
+}
+
+// loadEncryptionKey reads a base64-encoded 32 byte key from "env:NAME" or "file:PATH"
+func loadEncryptionKey(ref string) (*encryptionKey, error) {
+	var encoded string
+	if name, ok := strings.CutPrefix(ref, "env:"); ok {
+		encoded = os.Getenv(name)
+		if encoded == "" {
+			return nil, fmt.Errorf("encryption key variable %s is not set", name)
+		}
+	} else {
+		path := strings.TrimPrefix(ref, "file:")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		encoded = string(data)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key from %s must be 32 bytes, base64-encoded", ref)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &encryptionKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// additionalData binds the payload kind and key fingerprint into the tag
+func additionalData(kind, keyID string) []byte {
+	return []byte(kind + "\x00" + keyID)
+}
+
+// seal encrypts plaintext into a single-line JSON envelope
+func (c *fileCipher) seal(kind string, plaintext []byte) ([]byte, error) {
+	if c == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, c.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedFile{
+		Cipher: sealedCipher,
+		KeyID:  c.current.id,
+		Nonce:  nonce,
+		Data:   c.current.aead.Seal(nil, nonce, plaintext, additionalData(kind, c.current.id)),
+	})
+}
+
+// open returns the plaintext of data and whether it should be re-sealed
+// because it is plaintext or uses a previous key. With a key configured,
+// plaintext could have been written by anyone, so it only passes through
+// while migrating existing files.
+func (c *fileCipher) open(kind string, data []byte) ([]byte, bool, error) {
+	envelope, sealed := parseSealed(data)
+	switch {
+	case !sealed && c == nil:
+		return data, false, nil
+	case !sealed && c.migrate:
+		return data, true, nil
+	case !sealed:
+		return nil, false, fmt.Errorf("%w: not encrypted (set encryption.migrate_plaintext once to encrypt existing files)", ErrTampered)
+	}
+	if c == nil {
+		return nil, false, ErrEncrypted
+	}
+	if envelope.Cipher != sealedCipher {
+		return nil, false, fmt.Errorf("uses unsupported cipher %q", envelope.Cipher)
+	}
+
+	key, rotate := c.current, false
+	if envelope.KeyID != c.current.id {
+		if key = c.previous[envelope.KeyID]; key == nil {
+			return nil, false, fmt.Errorf("%w (key %s)", ErrWrongKey, envelope.KeyID)
+		}
+		rotate = true
+	}
+	if len(envelope.Nonce) != key.aead.NonceSize() {
+		// Open panics on a bad nonce length
+		return nil, false, ErrTampered
+	}
+	plaintext, err := key.aead.Open(nil, envelope.Nonce, envelope.Data, additionalData(kind, key.id))
+	if err != nil {
+		return nil, false, ErrTampered
+	}
+	return plaintext, rotate, nil
+}
+
+// parseSealed reports whether data is a sealed envelope rather than plaintext JSON
+func parseSealed(data []byte) (sealedFile, bool) {
+	var envelope sealedFile
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return envelope, false
+	}
+	return envelope, envelope.Cipher != "" && envelope.Data != nil
+}
@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKey stores a fresh random key in dir and returns its path
+func writeTestKey(t *testing.T, dir, name string) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	return path
+}
+
+func TestPersistentEncryption(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	dir := config.Database.DataDir
+	dataFile := filepath.Join(dir, dataFileName)
+	keyA := writeTestKey(t, dir, "a.key")
+	keyB := writeTestKey(t, dir, "b.key")
+	ctx := context.Background()
+
+	open := func(encryption EncryptionConfig) (*PersistentDatabase, error) {
+		config.Database.Encryption = encryption
+		db := NewPersistentDatabase(logger, config, nil)
+		return db, db.Initialize(ctx)
+	}
+	sealedKey := func() string {
+		data, err := os.ReadFile(dataFile)
+		require.NoError(t, err)
+		envelope, sealed := parseSealed(data)
+		require.True(t, sealed, "data file should be encrypted")
+		return envelope.KeyID
+	}
+
+	// An existing plaintext file is encrypted by a start that migrates it
+	db, err := open(EncryptionConfig{})
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+
+	db, err = open(EncryptionConfig{KeyFile: keyA, MigratePlaintext: true})
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+
+	db, err = open(EncryptionConfig{KeyFile: keyA})
+	require.NoError(t, err)
+	idA := sealedKey()
+	_, err = db.CreateUser(ctx, NewUser("secret", "Zelda"))
+	require.NoError(t, err)
+	journal, err := os.ReadFile(dataFile + ".journal")
+	require.NoError(t, err)
+	assert.NotContains(t, string(journal), "Zelda")
+	require.NoError(t, db.Close(ctx))
+
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Zelda")
+
+	// Rotating re-encrypts with the new key
+	t.Setenv("TEST_DATA_KEY", mustReadKey(t, keyB))
+	db, err = open(EncryptionConfig{KeyEnv: "TEST_DATA_KEY", PreviousKeys: []string{keyA}})
+	require.NoError(t, err)
+	user, err := db.GetUser(ctx, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "Zelda", user.Name)
+	require.NoError(t, db.Close(ctx))
+	assert.NotEqual(t, idA, sealedKey())
+
+	// The retired key alone no longer opens the file
+	_, err = open(EncryptionConfig{KeyFile: keyA})
+	assert.ErrorIs(t, err, ErrWrongKey)
+
+	_, err = open(EncryptionConfig{})
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	// Any modification fails authentication
+	data, err = os.ReadFile(dataFile)
+	require.NoError(t, err)
+	envelope, _ := parseSealed(data)
+	envelope.Data[0] ^= 1
+	tampered, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dataFile, tampered, 0600))
+	_, err = open(EncryptionConfig{KeyFile: keyB})
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestEncryptionRejectsPlaintext(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	dir := config.Database.DataDir
+	dataFile := filepath.Join(dir, dataFileName)
+	config.Database.Encryption = EncryptionConfig{KeyFile: writeTestKey(t, dir, "a.key")}
+	ctx := context.Background()
+
+	// A plaintext snapshot where an encrypted one belongs is not trusted
+	require.NoError(t, os.WriteFile(dataFile, []byte(`{"version":2,"users":{"1":{"id":"1","name":"Mallory"}}}`), 0600))
+	db := NewPersistentDatabase(logger, config, nil)
+	assert.ErrorIs(t, db.Initialize(ctx), ErrTampered)
+
+	config.Database.Encryption.MigratePlaintext = true
+	db = NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+	require.NoError(t, db.Close(ctx))
+	config.Database.Encryption.MigratePlaintext = false
+
+	// Nor is a plaintext line slipped into the journal
+	db = NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+	require.NoError(t, db.Close(ctx))
+	writeJournal(t, dataFile+".journal", journalEntry{Op: journalOpPut, ID: "2", User: NewUser("2", "Eve")})
+	db = NewPersistentDatabase(logger, config, nil)
+	assert.ErrorIs(t, db.Initialize(ctx), ErrTampered)
+}
+
+func TestAuditEncryptionMigration(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	dir := config.Database.DataDir
+	ctx := context.Background()
+
+	open := func() (*AuditingDatabase, error) {
+		db := NewAuditingDatabase(NewInMemoryDatabase(logger, config, nil), logger, config, nil)
+		return db, db.Initialize(ctx)
+	}
+
+	// History written before encryption is re-encrypted by the migration
+	db, err := open()
+	require.NoError(t, err)
+	_, err = db.CreateUser(ctx, NewUser("9", "Nina"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+
+	config.Database.Encryption = EncryptionConfig{KeyFile: writeTestKey(t, dir, "a.key")}
+	_, err = open()
+	assert.ErrorIs(t, err, ErrTampered)
+
+	config.Database.Encryption.MigratePlaintext = true
+	db, err = open()
+	require.NoError(t, err)
+	require.NoError(t, db.Close(ctx))
+	data, err := os.ReadFile(filepath.Join(dir, auditFileName))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Nina")
+
+	config.Database.Encryption.MigratePlaintext = false
+	db, err = open()
+	require.NoError(t, err)
+	defer db.Close(ctx)
+	entries, err := db.History(ctx, "9")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Nina", entries[0].After.Name)
+}
+
+// mustReadKey returns the encoded key stored at path
+func mustReadKey(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
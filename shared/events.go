@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Change event types
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// ErrEventsExpired is returned by Watch when the requested position is no
+// longer retained; the caller has to reload its state and watch from now
+var ErrEventsExpired = errors.New("change events no longer available")
+
+const (
+	// eventHistorySize is how many recent events a feed keeps for resuming watchers
+	eventHistorySize = 1024
+	// watcherBufferSize is how far a watcher may fall behind before it is dropped
+	watcherBufferSize = 64
+)
+
+// ChangeEvent describes one successful write
+// Seq increases by one per event on a feed and restarts with the process.
+type ChangeEvent struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	User *User     `json:"user,omitempty"` // State after the write; nil for deletes
+	Time time.Time `json:"time"`
+}
+
+// eventHub is a change feed with bounded history and non-blocking fan-out
+// A watcher that can't keep up has its channel closed instead of stalling
+// writers; it can resume from the last Seq it received.
+type eventHub struct {
+	metrics *Metrics
+
+	mu       sync.Mutex
+	seq      uint64
+	history  []ChangeEvent // ring buffer of the latest events
+	watchers map[chan ChangeEvent]struct{}
+}
+
+// newEventHub creates an empty change feed
+func newEventHub(metrics *Metrics) *eventHub {
+	return &eventHub{
+		metrics:  metrics,
+		history:  make([]ChangeEvent, 0, eventHistorySize),
+		watchers: make(map[chan ChangeEvent]struct{}),
+	}
+}
+
+// publish records an event and delivers it to every watcher
+func (h *eventHub) publish(eventType, id string, user *User) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	event := ChangeEvent{Seq: h.seq, Type: eventType, ID: id, User: user.Clone(), Time: time.Now().UTC()}
+	if len(h.history) < eventHistorySize {
+		h.history = append(h.history, event)
+	} else {
+		h.history[(h.seq-1)%eventHistorySize] = event
+	}
+
+	for ch := range h.watchers {
+		select {
+		case ch <- event:
+		default:
+			// Slow consumer: cut it loose rather than block the writer
+			delete(h.watchers, ch)
+			close(ch)
+			if h.metrics != nil {
+				h.metrics.RecordWatcherDropped()
+			}
+		}
+	}
+}
+
+// watch streams events after the given sequence number until ctx ends
+// after == 0 streams only new events. The channel is closed when ctx ends or
+// the watcher falls too far behind.
+func (h *eventHub) watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []ChangeEvent
+	if after > 0 {
+		if after > h.seq {
+			// Sequence numbers from before a restart
+			return nil, ErrEventsExpired
+		}
+		oldest := h.seq - uint64(len(h.history)) + 1
+		if after+1 < oldest {
+			return nil, ErrEventsExpired
+		}
+		for seq := after + 1; seq <= h.seq; seq++ {
+			backlog = append(backlog, h.history[(seq-1)%eventHistorySize])
+		}
+	}
+
+	ch := make(chan ChangeEvent, len(backlog)+watcherBufferSize)
+	for _, event := range backlog {
+		ch <- event
+	}
+	h.watchers[ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.watchers[ch]; ok {
+			delete(h.watchers, ch)
+			close(ch)
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchResumeAndBackpressure(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	db := NewInMemoryDatabase(logger, config, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := db.Watch(ctx, 0)
+	require.NoError(t, err)
+
+	_, err = db.CreateUser(ctx, NewUser("42", "Dana"))
+	require.NoError(t, err)
+	_, err = db.UpdateUser(ctx, &User{ID: "42", Name: "Dina"})
+	require.NoError(t, err)
+	require.NoError(t, db.DeleteUser(ctx, "42"))
+
+	var got []ChangeEvent
+	for range 3 {
+		got = append(got, <-events)
+	}
+	assert.Equal(t, []string{EventCreate, EventUpdate, EventDelete},
+		[]string{got[0].Type, got[1].Type, got[2].Type})
+	assert.Equal(t, "Dina", got[1].User.Name)
+	assert.Nil(t, got[2].User)
+
+	// Resuming replays everything after the given sequence number
+	resumed, err := db.Watch(ctx, got[0].Seq)
+	require.NoError(t, err)
+	assert.Equal(t, got[1].Seq, (<-resumed).Seq)
+	assert.Equal(t, got[2].Seq, (<-resumed).Seq)
+
+	_, err = db.Watch(ctx, got[2].Seq+100)
+	assert.ErrorIs(t, err, ErrEventsExpired)
+
+	// A watcher that never reads is dropped instead of blocking writers
+	for i := range 2 * watcherBufferSize {
+		_, err := db.UpdateUser(ctx, &User{ID: "1", Name: string(rune('A' + i%26))})
+		require.NoError(t, err)
+	}
+	for range resumed {
+	}
+	assert.Contains(t, metrics.GetStats(), "Slow Watchers Dropped")
+
+	// Cancelling the context closes the channel
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,210 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Policies for an external edit that races with unsaved changes, selected
+// by DatabaseConfig.EditConflictPolicy
+const (
+	EditPolicyDisk   = "disk"   // Reload the file, dropping unsaved changes
+	EditPolicyMemory = "memory" // Keep unsaved changes and overwrite the edit
+	EditPolicyNewest = "newest" // Whichever happened last wins
+)
+
+// diskState identifies the data file as this process last wrote or read it
+type diskState struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// editPolicy returns the configured conflict policy, defaulting to disk
+func (c *DatabaseConfig) editPolicy() string {
+	if c.EditConflictPolicy == "" {
+		return EditPolicyDisk
+	}
+	return c.EditConflictPolicy
+}
+
+// validEditPolicy reports whether policy names a known conflict policy
+func validEditPolicy(policy string) bool {
+	switch policy {
+	case EditPolicyDisk, EditPolicyMemory, EditPolicyNewest:
+		return true
+	}
+	return false
+}
+
+// rememberDisk records data as the current content of the data file
+func (d *PersistentDatabase) rememberDisk(data []byte) {
+	info, err := os.Stat(d.dataFile)
+	if err != nil {
+		return
+	}
+	d.disk.Store(&diskState{modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(data)})
+}
+
+// startEditWatch polls the data file for changes made by anyone else
+func (d *PersistentDatabase) startEditWatch() {
+	if d.config.EditCheckInterval <= 0 {
+		return
+	}
+	interval := time.Duration(d.config.EditCheckInterval) * time.Millisecond
+
+	d.stopEdits = make(chan struct{})
+	d.editsDone = make(chan struct{})
+
+	go func() {
+		defer close(d.editsDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-d.stopEdits:
+				return
+			}
+			if err := d.checkForEdits(); err != nil {
+				d.logger.Log("DATABASE", fmt.Sprintf("Error checking for external edits: %v", err))
+			}
+		}
+	}()
+}
+
+// stopEditWatch stops polling and waits for a check in progress
+func (d *PersistentDatabase) stopEditWatch() {
+	if d.stopEdits != nil {
+		close(d.stopEdits)
+		<-d.editsDone
+		d.stopEdits = nil
+	}
+}
+
+// checkForEdits reloads the data file if it no longer matches what this
+// process last wrote or read
+// Modification time and size make the common no-change case cheap; the
+// content hash rules out touches that didn't change anything.
+func (d *PersistentDatabase) checkForEdits() error {
+	known := d.disk.Load()
+	info, err := os.Stat(d.dataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Removed by hand; the next save writes it again
+			return nil
+		}
+		return err
+	}
+	if known != nil && info.ModTime().Equal(known.modTime) && info.Size() == known.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(d.dataFile)
+	if err != nil {
+		return err
+	}
+	state := &diskState{modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(data)}
+	if known != nil && state.hash == known.hash {
+		d.disk.CompareAndSwap(known, state)
+		return nil
+	}
+
+	snap, decodeErr := d.decodeSnapshot(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A snapshot written since the stat supersedes whatever was read
+	if !d.disk.CompareAndSwap(known, state) {
+		return nil
+	}
+	if decodeErr != nil {
+		// Most likely an edit in progress; the next change is checked again
+		return fmt.Errorf("ignoring unreadable edit of %s: %w", d.dataFile, decodeErr)
+	}
+
+	unsaved := d.unsaved.Load()
+	keepMemory := false
+	if unsaved > 0 {
+		switch d.config.editPolicy() {
+		case EditPolicyMemory:
+			keepMemory = true
+		case EditPolicyNewest:
+			keepMemory = d.lastChange.After(info.ModTime())
+		}
+	}
+	if keepMemory {
+		d.logger.Log("DATABASE", fmt.Sprintf("Data file %s was edited externally; keeping %d unsaved changes over it (policy: %s)",
+			d.dataFile, unsaved, d.config.editPolicy()))
+		return d.compactLocked()
+	}
+
+	if unsaved > 0 {
+		d.logger.Log("DATABASE", fmt.Sprintf("Discarding %d unsaved changes in favor of the edited data file (policy: %s)",
+			unsaved, d.config.editPolicy()))
+	}
+	created, updated, deleted := d.replaceUsersLocked(snap.users)
+	d.unsaved.Store(0)
+	if d.journal != nil {
+		if err := d.journal.Truncate(); err != nil {
+			return err
+		}
+	}
+	if d.metrics != nil {
+		d.metrics.RecordExternalReload()
+	}
+	d.logger.Log("DATABASE", fmt.Sprintf("Reloaded externally edited %s: %d created, %d updated, %d deleted",
+		d.dataFile, created, updated, deleted))
+
+	// Bring a hand-written file up to the current schema and key
+	if !d.readOnly && (snap.rekey || len(snap.migrations) > 0) {
+		return d.compactLocked()
+	}
+	return nil
+}
+
+// replaceUsersLocked swaps in users and publishes a change event for every
+// difference, so watchers and caches see edits made outside this process
+// Changed records get a new version, so ETags handed out before the edit go
+// stale even when the editor didn't bump it. Caller holds d.mu for writing.
+func (d *PersistentDatabase) replaceUsersLocked(users map[string]*User) (created, updated, deleted int) {
+	for id, user := range users {
+		old, ok := d.users[id]
+		if !ok {
+			d.events.publish(EventCreate, id, user)
+			created++
+			continue
+		}
+		if sameUser(old, user) {
+			// Keep the stored record so its version is unchanged
+			users[id] = old
+			continue
+		}
+		if user.Version <= old.Version {
+			user.Version = old.Version + 1
+		}
+		d.events.publish(EventUpdate, id, user)
+		updated++
+	}
+	for id := range d.users {
+		if _, ok := users[id]; !ok {
+			d.events.publish(EventDelete, id, nil)
+			deleted++
+		}
+	}
+	d.users = users
+	return created, updated, deleted
+}
+
+// sameUser reports whether two records hold the same data
+func sameUser(a, b *User) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
@@ -0,0 +1,86 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLocked is returned when another process already has the data file open
+var ErrLocked = errors.New("data file is in use by another process")
+
+// errLockBusy is returned by openLockFile when the lock is already held
+var errLockBusy = errors.New("lock is held")
+
+// lockHolder identifies the process holding a data file lock
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+// String describes the holder for error messages
+func (h lockHolder) String() string {
+	return fmt.Sprintf("pid %d (%s) on %s since %s", h.PID, h.Command, h.Host, h.Since.Format(time.RFC3339))
+}
+
+// fileLock is an exclusive lock on a data file, held through a sidecar file
+// The data file itself can't carry the lock because every snapshot replaces
+// it with a new file. The sidecar records who holds the lock so a second
+// process can name it when it gives up.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+// acquireFileLock locks dataFile for this process or fails straight away
+func acquireFileLock(dataFile string, perm os.FileMode) (*fileLock, error) {
+	path := dataFile + ".lock"
+	file, err := openLockFile(path, perm)
+	if errors.Is(err, errLockBusy) {
+		return nil, fmt.Errorf("%w: %s is held by %s", ErrLocked, dataFile, describeLockHolder(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock data file: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	command, _ := os.Executable()
+	holder, _ := json.Marshal(lockHolder{
+		PID:     os.Getpid(),
+		Host:    host,
+		Command: filepath.Base(command),
+		Since:   time.Now().UTC(),
+	})
+	lock := &fileLock{path: path, file: file}
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt(holder, 0)
+	}
+	if err != nil {
+		lock.release()
+		return nil, fmt.Errorf("failed to record lock holder: %w", err)
+	}
+	return lock, nil
+}
+
+// describeLockHolder reads who holds the lock at path
+func describeLockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "an unknown process"
+	}
+	var holder lockHolder
+	if err := json.Unmarshal(data, &holder); err != nil || holder.PID == 0 {
+		return "an unknown process"
+	}
+	return holder.String()
+}
+
+// release gives up the lock
+func (l *fileLock) release() error {
+	return closeLockFile(l.file, l.path)
+}
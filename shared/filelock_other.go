@@ -0,0 +1,25 @@
+//go:build !unix
+
+package shared
+
+import (
+	"errors"
+	"os"
+)
+
+// openLockFile creates the sidecar exclusively; its existence is the lock
+// Without flock a crashed process leaves the sidecar behind, and it has to be
+// removed by hand once the holder it names is confirmed gone.
+func openLockFile(path string, perm os.FileMode) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, os.ErrExist) {
+		return nil, errLockBusy
+	}
+	return file, err
+}
+
+// closeLockFile removes the sidecar, releasing the lock
+func closeLockFile(file *os.File, path string) error {
+	file.Close()
+	return os.Remove(path)
+}
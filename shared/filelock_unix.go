@@ -0,0 +1,39 @@
+//go:build unix
+
+package shared
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openLockFile opens the sidecar and takes a non-blocking flock on it
+// The kernel drops the lock when the process exits, so a crash never leaves
+// a stale lock behind; the sidecar file itself stays in place.
+func openLockFile(path string, perm os.FileMode) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLockBusy
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// closeLockFile clears the holder and drops the flock
+// The sidecar is not removed: another process may already have it open and be
+// about to lock it, and removing it would let a third lock a new file.
+func closeLockFile(file *os.File, path string) error {
+	file.Truncate(0)
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
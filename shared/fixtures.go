@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// fixtureFiles returns the fixture files for the configured environment:
+// the shared fixtures first, then the environment's own
+func (c *Config) fixtureFiles() []string {
+	files := append([]string(nil), c.Database.Fixtures...)
+	return append(files, c.Database.EnvironmentFixtures[c.App.Environment]...)
+}
+
+// seedsDefaults reports whether a backend should add its built-in demo users
+func (c *Config) seedsDefaults() bool {
+	return !c.Database.StartEmpty && len(c.fixtureFiles()) == 0
+}
+
+// loadFixtures reads users from fixture files in JSON, NDJSON or CSV, picked
+// by file extension. A user in a later file replaces one with the same ID
+// from an earlier file, so environment fixtures can override shared ones.
+// Missing timestamps are set to now and records start at version 1.
+func loadFixtures(paths []string) ([]*User, error) {
+	byID := make(map[string]*User)
+	var order []string
+	now := time.Now().UTC()
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open fixture file: %w", err)
+		}
+		err = decodeUsers(file, FormatFromPath(path), func(rec importRecord) error {
+			if rec.err == nil {
+				rec.err = validateImport(rec.user)
+			}
+			if rec.err != nil {
+				return fmt.Errorf("record %d: %w", rec.index, rec.err)
+			}
+
+			user := rec.user
+			if user.CreatedAt.IsZero() {
+				user.CreatedAt = now
+			}
+			if user.UpdatedAt.IsZero() {
+				user.UpdatedAt = user.CreatedAt
+			}
+			if user.Version == 0 {
+				user.Version = 1
+			}
+			if _, ok := byID[user.ID]; !ok {
+				order = append(order, user.ID)
+			}
+			byID[user.ID] = user
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixture file %s: %w", path, err)
+		}
+	}
+
+	users := make([]*User, 0, len(order))
+	for _, id := range order {
+		users = append(users, byID[id])
+	}
+	return users, nil
+}
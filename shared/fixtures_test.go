@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixtureSeeding(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "users.json")
+	staging := filepath.Join(dir, "staging.csv")
+	require.NoError(t, os.WriteFile(base, []byte(`[{"id":"a","name":"Ada"},{"id":"b","name":"Ben"}]`), 0600))
+	require.NoError(t, os.WriteFile(staging, []byte("id,name\nb,Benedict\nc,Cy\n"), 0600))
+
+	config := newMiddlewareTestConfig()
+	config.App.Environment = "staging"
+	config.Database.DataDir = dir
+	config.Database.Fixtures = []string{base}
+	config.Database.Sharding.Shards = []string{"inmemory", "persistent"}
+	config.Database.EnvironmentFixtures = map[string][]string{
+		"staging":    {staging},
+		"production": {filepath.Join(dir, "missing.csv")}, // Never read in staging
+	}
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	ctx := context.Background()
+
+	backends := map[string]Database{
+		"inmemory":   NewInMemoryDatabase(logger, config, metrics),
+		"persistent": NewPersistentDatabase(logger, config, metrics),
+	}
+	sharded, err := NewShardedDatabase(logger, config, metrics)
+	require.NoError(t, err)
+	backends["sharded"] = sharded
+
+	for name, db := range backends {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, db.Initialize(ctx))
+			defer db.Close(ctx)
+
+			// Environment fixtures override shared ones; no built-in demo users
+			users, err := db.ListUsers(ctx)
+			require.NoError(t, err)
+			require.Len(t, users, 3)
+			assert.Equal(t, "Benedict", users[1].Name)
+		})
+	}
+
+	// Starting empty skips the demo users
+	config.Database.Fixtures = nil
+	config.Database.EnvironmentFixtures = nil
+	config.Database.StartEmpty = true
+	users, err := NewInMemoryDatabase(logger, config, metrics).ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
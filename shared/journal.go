@@ -0,0 +1,197 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Journal operations
+const (
+	journalOpPut    = "put"
+	journalOpDelete = "delete"
+)
+
+// journalEntry is a single mutation recorded in the write-ahead journal
+type journalEntry struct {
+	Op   string `json:"op"`
+	ID   string `json:"id"`
+	User *User  `json:"user,omitempty"`
+}
+
+// journalFile is the part of *os.File the journal writes through
+type journalFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// ErrJournalFailed is returned by appends after a failed append could not be rolled back
+var ErrJournalFailed = errors.New("journal failed; appends resume after the next snapshot")
+
+// journal is an append-only, fsynced log of mutations made since the last snapshot
+type journal struct {
+	path   string
+	file   journalFile
+	cipher *fileCipher // encrypts each entry when configured
+	size   int64       // end of the last complete entry
+	failed error       // set when a torn entry could not be cut off
+}
+
+// openJournal opens (or creates) the journal file for appending
+func openJournal(path string, perm os.FileMode, cipher *fileCipher) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &journal{path: path, file: file, cipher: cipher, size: info.Size()}, nil
+}
+
+// Append writes one entry and syncs it to disk before returning
+// On failure the entry is cut off again, so a later append never lands after
+// half a line and a failed mutation is not replayed on the next start.
+func (j *journal) Append(entry journalEntry) error {
+	if j.failed != nil {
+		return j.failed
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if data, err = j.cipher.seal(sealJournal, data); err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if _, err := j.file.Write(data); err != nil {
+		return j.rollback(fmt.Errorf("failed to append to journal: %w", err))
+	}
+	if err := j.file.Sync(); err != nil {
+		return j.rollback(fmt.Errorf("failed to sync journal: %w", err))
+	}
+	j.size += int64(len(data))
+	return nil
+}
+
+// rollback truncates a failed append back to the last complete entry
+// If that fails too, the journal refuses appends until Truncate succeeds.
+func (j *journal) rollback(cause error) error {
+	err := j.file.Truncate(j.size)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.failed = fmt.Errorf("%w: failed to roll back: %v", ErrJournalFailed, err)
+		return errors.Join(cause, j.failed)
+	}
+	return cause
+}
+
+// Truncate discards all entries once they are covered by a snapshot
+func (j *journal) Truncate() error {
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.size = 0
+	j.failed = nil
+	return nil
+}
+
+// Close closes the journal file
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// replayJournal applies every complete entry in the journal at path
+// A torn final line from a crash mid-append is ignored; corruption anywhere else is an error
+func replayJournal(path string, cipher *fileCipher, apply func(journalEntry)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Anything left without a trailing newline was never fully written
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		line, _, err = cipher.open(sealJournal, line)
+		if err != nil {
+			return replayed, fmt.Errorf("journal entry %d: %w", replayed+1, err)
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return replayed, fmt.Errorf("corrupt journal entry %d: %w", replayed+1, err)
+		}
+		apply(entry)
+		replayed++
+	}
+}
+
+// writeFileAtomic replaces path with data so readers see either the old or the new contents
+// The data is written to a temp file in the same directory, synced, then renamed into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	// Clean up the temp file on any failure before the rename
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	success = true
+
+	// Sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeJournal appends entries to a journal at path, as a previous run would have
+func writeJournal(t *testing.T, path string, entries ...journalEntry) {
+	t.Helper()
+	j, err := openJournal(path, 0600, nil)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NoError(t, j.Append(entry))
+	}
+	require.NoError(t, j.Close())
+}
+
+// appendRaw adds bytes to path without any framing
+func appendRaw(t *testing.T, path, data string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func TestReplayJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path,
+		journalEntry{Op: journalOpPut, ID: "a", User: NewUser("a", "Ann")},
+		journalEntry{Op: journalOpDelete, ID: "b"},
+	)
+
+	replay := func() ([]journalEntry, error) {
+		var entries []journalEntry
+		_, err := replayJournal(path, nil, func(entry journalEntry) {
+			entries = append(entries, entry)
+		})
+		return entries, err
+	}
+
+	// A crash mid-append leaves a line without its newline
+	appendRaw(t, path, `{"op":"put","id":"c","us`)
+	entries, err := replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "Ann", entries[0].User.Name)
+	assert.Equal(t, journalOpDelete, entries[1].Op)
+
+	// Damage before the last line is not a torn write and must not be skipped
+	appendRaw(t, path, "\n")
+	writeJournal(t, path, journalEntry{Op: journalOpDelete, ID: "a"})
+	_, err = replay()
+	assert.ErrorContains(t, err, "corrupt journal entry 3")
+
+	count, err := replayJournal(filepath.Join(t.TempDir(), "missing"), nil, nil)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+// faultyJournalFile fails the next write halfway through, or the next sync or truncate
+type faultyJournalFile struct {
+	*os.File
+	failWrite, failSync, failTruncate bool
+}
+
+var errDiskFault = errors.New("disk fault")
+
+func (f *faultyJournalFile) Write(data []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.File.Write(data[:len(data)/2])
+		return n, errDiskFault
+	}
+	return f.File.Write(data)
+}
+
+func (f *faultyJournalFile) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errDiskFault
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyJournalFile) Truncate(size int64) error {
+	if f.failTruncate {
+		f.failTruncate = false
+		return errDiskFault
+	}
+	return f.File.Truncate(size)
+}
+
+func TestJournalAppendFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, journalEntry{Op: journalOpPut, ID: "a", User: NewUser("a", "Ann")})
+	j, err := openJournal(path, 0600, nil)
+	require.NoError(t, err)
+	defer j.Close()
+	file := &faultyJournalFile{File: j.file.(*os.File)}
+	j.file = file
+
+	replayed := func() []string {
+		var ids []string
+		_, err := replayJournal(path, nil, func(entry journalEntry) {
+			ids = append(ids, entry.ID)
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	// A short write is cut off, so the next entry starts on a clean line
+	file.failWrite = true
+	assert.ErrorIs(t, j.Append(journalEntry{Op: journalOpDelete, ID: "b"}), errDiskFault)
+	require.NoError(t, j.Append(journalEntry{Op: journalOpDelete, ID: "c"}))
+	assert.Equal(t, []string{"a", "c"}, replayed())
+
+	// An entry whose sync failed was reported as failed and must not come back
+	file.failSync = true
+	assert.ErrorIs(t, j.Append(journalEntry{Op: journalOpDelete, ID: "d"}), errDiskFault)
+	assert.Equal(t, []string{"a", "c"}, replayed())
+
+	// When the torn entry can't be cut off, appends stop until a snapshot
+	// starts the journal over
+	file.failWrite, file.failTruncate = true, true
+	assert.ErrorIs(t, j.Append(journalEntry{Op: journalOpDelete, ID: "e"}), ErrJournalFailed)
+	assert.ErrorIs(t, j.Append(journalEntry{Op: journalOpDelete, ID: "f"}), ErrJournalFailed)
+	assert.Equal(t, []string{"a", "c"}, replayed())
+	require.NoError(t, j.Truncate())
+	require.NoError(t, j.Append(journalEntry{Op: journalOpDelete, ID: "g"}))
+	assert.Equal(t, []string{"g"}, replayed())
+}
+
+func TestPersistentJournalRecovery(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.StartEmpty = true
+	dataFile := filepath.Join(config.Database.DataDir, dataFileName)
+	journal := dataFile + ".journal"
+
+	// The previous run crashed after writing its snapshot but before
+	// truncating the journal, then tore an entry made after it
+	ann := NewUser("a", "Ann")
+	ann.Version = 2
+	bob := NewUser("b", "Bob")
+	data, err := encodeDataFile(map[string]*User{"a": ann, "b": bob})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dataFile, data, 0600))
+	writeJournal(t, journal,
+		journalEntry{Op: journalOpPut, ID: "a", User: NewUser("a", "Annie")},
+		journalEntry{Op: journalOpPut, ID: "a", User: ann},
+		journalEntry{Op: journalOpPut, ID: "c", User: NewUser("c", "Cy")},
+		journalEntry{Op: journalOpDelete, ID: "c"},
+		journalEntry{Op: journalOpPut, ID: "b", User: bob},
+	)
+	appendRaw(t, journal, `{"op":"delete","id":"b"`)
+
+	ctx := context.Background()
+	logger := NewLogger(config)
+	db := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+
+	// Entries already in the snapshot are full records, so replaying them lands
+	// on the same state instead of applying twice
+	users, err := db.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	user, err := db.GetUser(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "Ann", user.Name)
+	assert.Equal(t, uint64(2), user.Version)
+
+	// The replay was folded into a snapshot, so the torn line is gone and new
+	// entries start on a clean line
+	info, err := os.Stat(journal)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	_, err = db.CreateUser(ctx, NewUser("d", "Dee"))
+	require.NoError(t, err)
+	// Crash: the process goes away without a final snapshot
+	db.stopCompaction()
+	require.NoError(t, db.closeFiles())
+
+	reopened := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, reopened.Initialize(ctx))
+	defer reopened.Close(ctx)
+	users, err = reopened.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, 3)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+
+	require.NoError(t, writeFileAtomic(path, []byte("new"), 0600))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The temp file was renamed into place, not left next to it
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// A failed rename leaves the target as it was and no temp file behind
+	taken := filepath.Join(dir, "taken")
+	require.NoError(t, os.MkdirAll(filepath.Join(taken, "child"), 0755))
+	require.Error(t, writeFileAtomic(taken, []byte("x"), 0600))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,21 +16,124 @@ type Metrics struct {
 	userLookups     *atomic.Int64
 	cacheHits       *atomic.Int64
 	cacheMisses     *atomic.Int64
+	cacheEvictions  *atomic.Int64
 	requestDuration map[string][]time.Duration
 	enabled         bool
+
+	// Per-operation database metrics
+	dbOperations map[string]*operationStats
+	dbRetries    *atomic.Int64
+	circuitState atomic.Value // string
+	circuitTrips *atomic.Int64
+
+	// Connection pool metrics
+	poolCapacity   *atomic.Int64
+	poolInUse      *atomic.Int64
+	poolPeakInUse  *atomic.Int64
+	poolAcquired   *atomic.Int64
+	poolWaitTotal  *atomic.Int64 // nanoseconds
+	poolRejections *atomic.Int64
+
+	// Replication metrics
+	replicas  map[string]ReplicaStatus
+	failovers *atomic.Int64
+
+	// Sharding metrics
+	shardSizes map[string]int64
+
+	// Change feed metrics
+	watchersDropped *atomic.Int64
+
+	// Audit log metrics
+	auditEntries  *atomic.Int64
+	auditFailures *atomic.Int64
+
+	// Persistence metrics
+	saves        *atomic.Int64
+	saveFailures *atomic.Int64
+	saveTotal    *atomic.Int64 // nanoseconds
+	saveMax      *atomic.Int64 // nanoseconds
+	lastSave     atomic.Value  // time.Time
+	reloads      *atomic.Int64
+
+	// Per-tenant metrics; a tenant's counters also count toward its parent
+	tenant  string
+	parent  *Metrics
+	tenants map[string]*Metrics
+}
+
+// ReplicaStatus describes one member of a replicated database
+type ReplicaStatus struct {
+	Role       string
+	Healthy    bool
+	Resyncing  bool
+	PendingOps int64
+	Lag        time.Duration
+}
+
+// operationStats aggregates calls to a single database operation
+type operationStats struct {
+	calls    int64
+	errors   int64
+	duration time.Duration
 }
 
 // NewMetrics creates a new metrics collector
 func NewMetrics(config *Config) *Metrics {
+	return newMetrics(config.App.Features["metrics_enabled"])
+}
+
+// newMetrics creates an empty collector
+func newMetrics(enabled bool) *Metrics {
 	return &Metrics{
 		httpRequests:    make(map[string]*atomic.Int64),
 		dbQueries:       &atomic.Int64{},
 		userLookups:     &atomic.Int64{},
 		cacheHits:       &atomic.Int64{},
 		cacheMisses:     &atomic.Int64{},
+		cacheEvictions:  &atomic.Int64{},
 		requestDuration: make(map[string][]time.Duration),
-		enabled:         config.App.Features["metrics_enabled"],
+		enabled:         enabled,
+		dbOperations:    make(map[string]*operationStats),
+		dbRetries:       &atomic.Int64{},
+		circuitTrips:    &atomic.Int64{},
+		poolCapacity:    &atomic.Int64{},
+		poolInUse:       &atomic.Int64{},
+		poolPeakInUse:   &atomic.Int64{},
+		poolAcquired:    &atomic.Int64{},
+		poolWaitTotal:   &atomic.Int64{},
+		poolRejections:  &atomic.Int64{},
+		replicas:        make(map[string]ReplicaStatus),
+		failovers:       &atomic.Int64{},
+		shardSizes:      make(map[string]int64),
+		watchersDropped: &atomic.Int64{},
+		auditEntries:    &atomic.Int64{},
+		auditFailures:   &atomic.Int64{},
+		saves:           &atomic.Int64{},
+		saveFailures:    &atomic.Int64{},
+		saveTotal:       &atomic.Int64{},
+		saveMax:         &atomic.Int64{},
+		reloads:         &atomic.Int64{},
+		tenants:         make(map[string]*Metrics),
+	}
+}
+
+// ForTenant returns the metrics of one tenant, creating them on first use
+// Counters recorded there count toward m as well, and so does pool usage, as
+// tenants share the pool; gauges such as replica status and shard sizes are
+// kept per tenant only.
+func (m *Metrics) ForTenant(tenant string) *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.tenants[tenant]; ok {
+		return t
 	}
+	t := newMetrics(m.enabled)
+	t.tenant = tenant
+	t.parent = m
+	m.tenants[tenant] = t
+	return t
 }
 
 // RecordHTTPRequest records an HTTP request
@@ -37,6 +141,9 @@ func (m *Metrics) RecordHTTPRequest(endpoint string, duration time.Duration) {
 	if !m.enabled {
 		return
 	}
+	if m.parent != nil {
+		m.parent.RecordHTTPRequest(endpoint, duration)
+	}
 	
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -53,14 +160,71 @@ func (m *Metrics) RecordDBQuery() {
 	if !m.enabled {
 		return
 	}
+	if m.parent != nil {
+		m.parent.RecordDBQuery()
+	}
 	m.dbQueries.Add(1)
 }
 
+// RecordDBOperation records the latency and outcome of one database operation
+func (m *Metrics) RecordDBOperation(op string, duration time.Duration, failed bool) {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordDBOperation(op, duration, failed)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.dbOperations[op]
+	if !ok {
+		stats = &operationStats{}
+		m.dbOperations[op] = stats
+	}
+	stats.calls++
+	stats.duration += duration
+	if failed {
+		stats.errors++
+	}
+}
+
+// RecordDBRetry increments the database retry counter
+func (m *Metrics) RecordDBRetry() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordDBRetry()
+	}
+	m.dbRetries.Add(1)
+}
+
+// RecordCircuitTrip increments the count of times the circuit breaker opened
+func (m *Metrics) RecordCircuitTrip() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordCircuitTrip()
+	}
+	m.circuitTrips.Add(1)
+}
+
+// SetCircuitState records the circuit breaker's current state
+func (m *Metrics) SetCircuitState(state string) {
+	m.circuitState.Store(state)
+}
+
 // RecordUserLookup increments the user lookup counter
 func (m *Metrics) RecordUserLookup() {
 	if !m.enabled {
 		return
 	}
+	if m.parent != nil {
+		m.parent.RecordUserLookup()
+	}
 	m.userLookups.Add(1)
 }
 
@@ -69,6 +233,9 @@ func (m *Metrics) RecordCacheHit() {
 	if !m.enabled {
 		return
 	}
+	if m.parent != nil {
+		m.parent.RecordCacheHit()
+	}
 	m.cacheHits.Add(1)
 }
 
@@ -77,9 +244,171 @@ func (m *Metrics) RecordCacheMiss() {
 	if !m.enabled {
 		return
 	}
+	if m.parent != nil {
+		m.parent.RecordCacheMiss()
+	}
 	m.cacheMisses.Add(1)
 }
 
+// RecordCacheEviction increments the cache eviction counter
+func (m *Metrics) RecordCacheEviction() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordCacheEviction()
+	}
+	m.cacheEvictions.Add(1)
+}
+
+// SetPoolCapacity records the configured connection limit
+func (m *Metrics) SetPoolCapacity(capacity int) {
+	m.poolCapacity.Store(int64(capacity))
+}
+
+// RecordPoolAcquire records a granted connection and how long the caller queued for it
+func (m *Metrics) RecordPoolAcquire(wait time.Duration) {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordPoolAcquire(wait)
+	}
+	m.poolAcquired.Add(1)
+	m.poolWaitTotal.Add(int64(wait))
+	inUse := m.poolInUse.Add(1)
+	for {
+		peak := m.poolPeakInUse.Load()
+		if inUse <= peak || m.poolPeakInUse.CompareAndSwap(peak, inUse) {
+			break
+		}
+	}
+}
+
+// RecordPoolRelease records a connection being returned to the pool
+func (m *Metrics) RecordPoolRelease() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordPoolRelease()
+	}
+	m.poolInUse.Add(-1)
+}
+
+// RecordPoolRejection increments the count of callers that gave up waiting
+func (m *Metrics) RecordPoolRejection() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordPoolRejection()
+	}
+	m.poolRejections.Add(1)
+}
+
+// SetReplicaStatus records the current role, health and lag of a replica set member
+func (m *Metrics) SetReplicaStatus(name string, status ReplicaStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replicas[name] = status
+}
+
+// RecordFailover increments the count of primary failovers
+func (m *Metrics) RecordFailover() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordFailover()
+	}
+	m.failovers.Add(1)
+}
+
+// SetShardSize records the number of users stored on a shard
+func (m *Metrics) SetShardSize(name string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shardSizes[name] = size
+}
+
+// RecordWatcherDropped increments the count of change feed watchers cut off for falling behind
+func (m *Metrics) RecordWatcherDropped() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordWatcherDropped()
+	}
+	m.watchersDropped.Add(1)
+}
+
+// RecordAuditEntry counts an audit log append, or a failed one
+func (m *Metrics) RecordAuditEntry(failed bool) {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordAuditEntry(failed)
+	}
+	if failed {
+		m.auditFailures.Add(1)
+		return
+	}
+	m.auditEntries.Add(1)
+}
+
+// RecordSave records how long writing a snapshot of the data file took
+func (m *Metrics) RecordSave(duration time.Duration, failed bool) {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordSave(duration, failed)
+	}
+	if failed {
+		m.saveFailures.Add(1)
+		return
+	}
+	m.saves.Add(1)
+	m.saveTotal.Add(int64(duration))
+	for {
+		peak := m.saveMax.Load()
+		if int64(duration) <= peak || m.saveMax.CompareAndSwap(peak, int64(duration)) {
+			break
+		}
+	}
+	m.lastSave.Store(time.Now())
+}
+
+// RecordExternalReload counts reloads of a data file edited outside the process
+func (m *Metrics) RecordExternalReload() {
+	if !m.enabled {
+		return
+	}
+	if m.parent != nil {
+		m.parent.RecordExternalReload()
+	}
+	m.reloads.Add(1)
+}
+
+// summary describes a tenant's traffic on one line
+func (m *Metrics) summary() string {
+	m.mu.RLock()
+	requests := int64(0)
+	for _, count := range m.httpRequests {
+		requests += count.Load()
+	}
+	m.mu.RUnlock()
+
+	hits, misses := m.cacheHits.Load(), m.cacheMisses.Load()
+	hitRate := float64(0)
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses) * 100
+	}
+	return fmt.Sprintf("%d requests, %d queries, cache hit rate %.1f%%", requests, m.dbQueries.Load(), hitRate)
+}
+
 // GetStats returns current metrics as a string
 func (m *Metrics) GetStats() string {
 	if !m.enabled {
@@ -90,6 +419,9 @@ func (m *Metrics) GetStats() string {
 	defer m.mu.RUnlock()
 	
 	stats := "=== Application Metrics ===\n\n"
+	if m.tenant != "" {
+		stats = fmt.Sprintf("=== Metrics for Tenant %s ===\n\n", m.tenant)
+	}
 	
 	// HTTP metrics
 	stats += "HTTP Requests:\n"
@@ -107,6 +439,22 @@ func (m *Metrics) GetStats() string {
 	
 	// Database metrics
 	stats += fmt.Sprintf("\nDatabase:\n  Queries: %d\n", m.dbQueries.Load())
+	ops := make([]string, 0, len(m.dbOperations))
+	for op := range m.dbOperations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		s := m.dbOperations[op]
+		stats += fmt.Sprintf("  %s: %d calls, %d errors (avg: %v)\n",
+			op, s.calls, s.errors, s.duration/time.Duration(s.calls))
+	}
+	if state, ok := m.circuitState.Load().(string); ok {
+		stats += fmt.Sprintf("  Retries: %d\n  Circuit Breaker: %s (trips: %d)\n",
+			m.dbRetries.Load(), state, m.circuitTrips.Load())
+	} else if retries := m.dbRetries.Load(); retries > 0 {
+		stats += fmt.Sprintf("  Retries: %d\n", retries)
+	}
 	
 	// Cache metrics
 	hits := m.cacheHits.Load()
@@ -116,11 +464,104 @@ func (m *Metrics) GetStats() string {
 	if total > 0 {
 		hitRate = float64(hits) / float64(total) * 100
 	}
-	stats += fmt.Sprintf("\nCache:\n  Hits: %d\n  Misses: %d\n  Hit Rate: %.1f%%\n", 
-		hits, misses, hitRate)
+	stats += fmt.Sprintf("\nCache:\n  Hits: %d\n  Misses: %d\n  Hit Rate: %.1f%%\n  Evictions: %d\n", 
+		hits, misses, hitRate, m.cacheEvictions.Load())
 	
+	// Connection pool metrics
+	if capacity := m.poolCapacity.Load(); capacity > 0 {
+		inUse := m.poolInUse.Load()
+		acquired := m.poolAcquired.Load()
+		avgWait := time.Duration(0)
+		if acquired > 0 {
+			avgWait = time.Duration(m.poolWaitTotal.Load() / acquired)
+		}
+		stats += fmt.Sprintf("\nConnection Pool:\n  In Use: %d/%d (%.1f%%)\n  Peak In Use: %d\n  Acquired: %d\n  Avg Wait: %v\n  Rejections: %d\n",
+			inUse, capacity, float64(inUse)/float64(capacity)*100, m.poolPeakInUse.Load(),
+			acquired, avgWait, m.poolRejections.Load())
+	}
+
+	// Replication metrics
+	if len(m.replicas) > 0 {
+		stats += fmt.Sprintf("\nReplication:\n  Failovers: %d\n", m.failovers.Load())
+		names := make([]string, 0, len(m.replicas))
+		for name := range m.replicas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r := m.replicas[name]
+			health := "healthy"
+			if !r.Healthy {
+				health = "down"
+			} else if r.Resyncing {
+				health = "resyncing"
+			}
+			stats += fmt.Sprintf("  %s: %s, %s, pending: %d, lag: %v\n",
+				name, r.Role, health, r.PendingOps, r.Lag)
+		}
+	}
+
+	// Sharding metrics
+	if len(m.shardSizes) > 0 {
+		stats += "\nShards:\n"
+		names := make([]string, 0, len(m.shardSizes))
+		for name := range m.shardSizes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			stats += fmt.Sprintf("  %s: %d users\n", name, m.shardSizes[name])
+		}
+	}
+
+	// Change feed metrics
+	if dropped := m.watchersDropped.Load(); dropped > 0 {
+		stats += fmt.Sprintf("\nChange Feed:\n  Slow Watchers Dropped: %d\n", dropped)
+	}
+
+	// Persistence metrics
+	saves, failures, reloads := m.saves.Load(), m.saveFailures.Load(), m.reloads.Load()
+	if saves+failures+reloads > 0 {
+		stats += fmt.Sprintf("\nPersistence:\n  Saves: %d (failures: %d)\n", saves, failures)
+		if last, ok := m.lastSave.Load().(time.Time); ok {
+			stats += fmt.Sprintf("  Avg Flush: %v\n  Max Flush: %v\n  Last Save: %s (%v ago)\n",
+				time.Duration(m.saveTotal.Load()/saves), time.Duration(m.saveMax.Load()),
+				last.Format(time.RFC3339), time.Since(last).Round(time.Second))
+		}
+		if reloads > 0 {
+			stats += fmt.Sprintf("  External Edits Reloaded: %d\n", reloads)
+		}
+	}
+
+	// Audit log metrics
+	if entries, failures := m.auditEntries.Load(), m.auditFailures.Load(); entries+failures > 0 {
+		stats += fmt.Sprintf("\nAudit Log:\n  Entries: %d\n  Write Failures: %d\n", entries, failures)
+	}
+
 	// Business metrics
 	stats += fmt.Sprintf("\nBusiness:\n  User Lookups: %d\n", m.userLookups.Load())
 	
 	return stats
-}
\ No newline at end of file
+}
+
+// TenantStats summarizes each tenant's traffic on its own line
+// It names every tenant, so it is only served to admins.
+func (m *Metrics) TenantStats() string {
+	if !m.enabled {
+		return "Metrics disabled"
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := "=== Tenant Metrics ===\n\n"
+	names := make([]string, 0, len(m.tenants))
+	for name := range m.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats += fmt.Sprintf("  %s: %s\n", name, m.tenants[name].summary())
+	}
+	return stats
+}
@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew is returned when a data file was written by a newer release
+var ErrSchemaTooNew = errors.New("data file schema is newer than this release supports")
+
+// dataFile is the on-disk layout of the persistent snapshot
+// Files from before the header existed are a bare map of users and count as version 0.
+type dataFile struct {
+	Version int             `json:"version"`
+	Users   json.RawMessage `json:"users"`
+}
+
+// schemaMigration upgrades the users section of a data file by one version
+type schemaMigration struct {
+	description string
+	apply       func(users json.RawMessage) (json.RawMessage, error)
+}
+
+// schemaMigrations holds the upgrade from version i to i+1 at index i
+// Append new migrations; never reorder or edit released ones.
+var schemaMigrations = []schemaMigration{
+	{description: "convert name-only entries to structured users", apply: migrateNameOnlyUsers},
+	{description: "add record versions", apply: migrateRecordVersions},
+}
+
+// currentSchemaVersion is the version written by this release
+var currentSchemaVersion = len(schemaMigrations)
+
+// decodeDataFile splits a data file into its schema version and users section
+func decodeDataFile(data []byte) (int, json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, nil, err
+	}
+
+	// A legacy map never holds a number, so a numeric "version" marks the header
+	var version int
+	if err := json.Unmarshal(fields["version"], &version); err != nil || fields["users"] == nil {
+		return 0, data, nil
+	}
+	if version < 0 {
+		return 0, nil, fmt.Errorf("invalid schema version %d", version)
+	}
+	return version, fields["users"], nil
+}
+
+// encodeDataFile wraps users in a header for the current schema version
+func encodeDataFile(users map[string]*User) ([]byte, error) {
+	section, err := json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(dataFile{Version: currentSchemaVersion, Users: section}, "", "  ")
+}
+
+// migrateSchema upgrades users from version to currentSchemaVersion and
+// returns the descriptions of the steps it applied
+func migrateSchema(version int, users json.RawMessage) (json.RawMessage, []string, error) {
+	if version > currentSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: file is version %d, supported up to %d",
+			ErrSchemaTooNew, version, currentSchemaVersion)
+	}
+
+	var applied []string
+	for v := version; v < currentSchemaVersion; v++ {
+		migration := schemaMigrations[v]
+		upgraded, err := migration.apply(users)
+		if err != nil {
+			return nil, nil, fmt.Errorf("migrating schema %d to %d (%s): %w", v, v+1, migration.description, err)
+		}
+		users = upgraded
+		applied = append(applied, fmt.Sprintf("%d->%d: %s", v, v+1, migration.description))
+	}
+	return users, applied, nil
+}
+
+// migrateNameOnlyUsers turns entries mapping an ID straight to a name into
+// full User records and fills in IDs missing from structured entries
+func migrateNameOnlyUsers(section json.RawMessage) (json.RawMessage, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(section, &raw); err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*User, len(raw))
+	for id, entry := range raw {
+		var name string
+		if err := json.Unmarshal(entry, &name); err == nil {
+			users[id] = NewUser(id, name)
+			continue
+		}
+
+		var user User
+		if err := json.Unmarshal(entry, &user); err != nil {
+			return nil, fmt.Errorf("invalid record for user %s: %w", id, err)
+		}
+		user.ID = id
+		users[id] = &user
+	}
+	return json.Marshal(users)
+}
+
+// migrateRecordVersions starts every record that predates versioning at 1
+func migrateRecordVersions(section json.RawMessage) (json.RawMessage, error) {
+	var users map[string]*User
+	if err := json.Unmarshal(section, &users); err != nil {
+		return nil, err
+	}
+	for id, user := range users {
+		if user == nil {
+			return nil, fmt.Errorf("invalid record for user %s: null", id)
+		}
+		if user.Version == 0 {
+			user.Version = 1
+		}
+	}
+	return json.Marshal(users)
+}
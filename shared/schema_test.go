@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentSchemaMigration(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	logger := NewLogger(config)
+	path := filepath.Join(config.Database.DataDir, dataFileName)
+	legacy := []byte(`{"1": "Alice", "2": {"name": "Bob", "email": "bob@example.com"}}`)
+	require.NoError(t, os.WriteFile(path, legacy, 0600))
+
+	ctx := context.Background()
+	db := NewPersistentDatabase(logger, config, nil)
+	require.NoError(t, db.Initialize(ctx))
+
+	users, err := db.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "Alice", users[0].Name)
+	assert.Equal(t, "bob@example.com", users[1].Email)
+	require.NoError(t, db.Close(ctx))
+
+	// The original is kept and the file now carries the current version
+	backup, err := os.ReadFile(path + ".v0.bak")
+	require.NoError(t, err)
+	assert.Equal(t, legacy, backup)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	version, _, err := decodeDataFile(data)
+	require.NoError(t, err)
+	assert.Equal(t, currentSchemaVersion, version)
+
+	// Files from a newer release are refused and left untouched
+	future := []byte(`{"version": 99, "users": {}}`)
+	require.NoError(t, os.WriteFile(path, future, 0600))
+	err = NewPersistentDatabase(logger, config, nil).Initialize(ctx)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, future, data)
+}
@@ -2,14 +2,21 @@ package shared
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
+// HeaderActor lets a caller say who it acts for; anyone can set it, so the
+// audit log keeps it as claimed_actor next to the authenticated actor
+const HeaderActor = "X-Actor"
+
 // Server represents the HTTP server
 type Server struct {
 	echo    *echo.Echo
@@ -22,15 +29,30 @@ type Server struct {
 // NOTE: In v2, we added metrics parameter - yet another breaking change!
 func NewServer(userService *UserService, logger *Logger, config *Config, metrics *Metrics) *Server {
 	e := echo.New()
-	
+
 	// Disable Echo's default logger
 	e.HideBanner = true
 	e.HidePort = true
-	
+
 	// Add middleware
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
-	
+
+	// Requests are anonymous until they authenticate; what they claim to be,
+	// and where they came from, is logged alongside
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := WithActor(c.Request().Context(), anonymousActor)
+			ctx = withRequestOrigin(ctx, requestOrigin{
+				claimedActor: c.Request().Header.Get(HeaderActor),
+				requestID:    c.Response().Header().Get(echo.HeaderXRequestID),
+				remoteAddr:   c.Request().RemoteAddr,
+			})
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	})
+
 	// Metrics middleware - track all HTTP requests
 	if metrics != nil {
 		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -38,19 +60,23 @@ func NewServer(userService *UserService, logger *Logger, config *Config, metrics
 				start := time.Now()
 				err := next(c)
 				duration := time.Since(start)
-				
+
 				// Record metrics
 				path := c.Path()
 				if path == "" {
 					path = c.Request().URL.Path
 				}
-				metrics.RecordHTTPRequest(path, duration)
-				
+				recorder := metrics
+				if tenant := TenantFromContext(c.Request().Context()); tenant != "" {
+					recorder = metrics.ForTenant(tenant)
+				}
+				recorder.RecordHTTPRequest(path, duration)
+
 				return err
 			}
 		})
 	}
-	
+
 	// Custom logger middleware
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -59,23 +85,63 @@ func NewServer(userService *UserService, logger *Logger, config *Config, metrics
 			return err
 		}
 	})
-	
+
+	// Routes that reach user data belong to a tenant when tenancy is enabled
+	var data []echo.MiddlewareFunc
+	if config.Tenancy.Enabled {
+		data = append(data, tenantMiddleware(&config.Tenancy))
+	}
+
 	// Register routes
-	e.GET("/user", userService.GetUserHandler)
+	e.GET("/user", userService.GetUserHandler, data...)
+	e.GET("/users", userService.ListUsersHandler, data...)
+	e.GET("/users/events", userService.WatchUsersHandler, data...)
+	e.POST("/users", userService.CreateUserHandler, data...)
+	e.PUT("/users/:id", userService.UpdateUserHandler, data...)
+	e.DELETE("/users/:id", userService.DeleteUserHandler, data...)
+	e.GET("/users/:id/history", userService.UserHistoryHandler, data...)
+
+	// Dataset export and import, only when the admin API is switched on and
+	// has a token to check callers against
+	if config.App.Features["admin_api"] {
+		if token := config.App.adminToken(); token != "" {
+			admin := e.Group("/admin", append([]echo.MiddlewareFunc{adminAuth(token)}, data...)...)
+			admin.GET("/export", userService.ExportUsersHandler)
+			admin.POST("/import", userService.ImportUsersHandler)
+
+			// The per-tenant breakdown names every tenant, so it isn't in /metrics
+			e.GET("/admin/metrics/tenants", func(c echo.Context) error {
+				if metrics == nil {
+					return c.String(http.StatusNotFound, "Metrics not enabled")
+				}
+				return c.String(http.StatusOK, metrics.TenantStats())
+			}, adminAuth(token))
+		} else {
+			logger.Log("SERVER", "admin_api is enabled but no admin token is set; admin routes are disabled")
+		}
+	}
+
 	e.GET("/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "OK")
 	})
-	
-	// Add config endpoint to show configuration in use
+
+	// Add config endpoint to show configuration in use, minus secrets
 	e.GET("/config", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, config)
+		return c.JSON(http.StatusOK, config.redacted())
 	})
-	
-	// Add metrics endpoint
+
+	// Add metrics endpoint; a request naming a tenant sees only that tenant's
+	// metrics, and other requests see totals across all tenants
 	e.GET("/metrics", func(c echo.Context) error {
 		if metrics == nil {
 			return c.String(http.StatusNotFound, "Metrics not enabled")
 		}
+		if tenant := config.Tenancy.requestTenant(c.Request()); config.Tenancy.Enabled && tenant != "" {
+			if !config.Tenancy.admits(tenant) {
+				return c.String(http.StatusNotFound, "Unknown tenant")
+			}
+			return c.String(http.StatusOK, metrics.ForTenant(tenant).GetStats())
+		}
 		return c.String(http.StatusOK, metrics.GetStats())
 	})
 
@@ -87,6 +153,44 @@ func NewServer(userService *UserService, logger *Logger, config *Config, metrics
 	}
 }
 
+// adminAuth rejects requests without "Authorization: Bearer <token>"
+func adminAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			given, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.String(http.StatusUnauthorized, "Admin token required")
+			}
+			c.SetRequest(c.Request().WithContext(WithActor(c.Request().Context(), adminActor)))
+			return next(c)
+		}
+	}
+}
+
+// tenantMiddleware puts the tenant a request names, or the default tenant,
+// into its context and rejects requests without a usable one
+func tenantMiddleware(config *TenancyConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant, err := config.resolve(config.requestTenant(c.Request()))
+			switch {
+			case errors.Is(err, ErrNoTenant):
+				return c.String(http.StatusBadRequest, "Tenant required: set the "+config.header()+" header")
+			case err != nil:
+				return c.String(http.StatusNotFound, "Unknown tenant")
+			}
+			c.SetRequest(c.Request().WithContext(WithTenant(c.Request().Context(), tenant)))
+			return next(c)
+		}
+	}
+}
+
+// ServeHTTP lets the server handle a single request without binding a port
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.echo.ServeHTTP(w, r)
+}
+
 // Start begins listening for HTTP requests
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%s", s.config.Host, s.config.Port)
@@ -98,4 +202,4 @@ func (s *Server) Start() error {
 func (s *Server) Stop(ctx context.Context) error {
 	s.logger.Log("SERVER", "Stopping server...")
 	return s.echo.Shutdown(ctx)
-}
\ No newline at end of file
+}
@@ -0,0 +1,363 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Errors returned when an operation can't be tied to a tenant
+var (
+	ErrNoTenant      = errors.New("no tenant specified")
+	ErrUnknownTenant = errors.New("unknown tenant")
+)
+
+// DefaultTenantHeader names the tenant of a request unless tenancy.header is set
+const DefaultTenantHeader = "X-Tenant-ID"
+
+// tenantIDPattern keeps IDs usable both as a DNS label and as a directory name
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantKey carries the tenant an operation belongs to in a context
+type tenantKey struct{}
+
+// WithTenant returns a context whose database operations belong to tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set by WithTenant, or "" if there is none
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// header returns the request header that names the tenant
+func (c *TenancyConfig) header() string {
+	if c.Header == "" {
+		return DefaultTenantHeader
+	}
+	return c.Header
+}
+
+// validate checks the configured tenant IDs
+func (c *TenancyConfig) validate() error {
+	if c.Enabled && len(c.Tenants) == 0 {
+		// Every tenant costs a database stack, so callers can't conjure new ones
+		return fmt.Errorf("tenancy needs the list of tenants to serve")
+	}
+	for _, tenant := range c.Tenants {
+		if !tenantIDPattern.MatchString(tenant) {
+			return fmt.Errorf("invalid tenant %q: expected lowercase letters, digits and dashes", tenant)
+		}
+	}
+	if c.Default != "" && !c.admits(c.Default) {
+		return fmt.Errorf("invalid default tenant %q: not a configured tenant", c.Default)
+	}
+	return nil
+}
+
+// admits reports whether tenant may be served
+func (c *TenancyConfig) admits(tenant string) bool {
+	return tenantIDPattern.MatchString(tenant) && slices.Contains(c.Tenants, tenant)
+}
+
+// resolve picks the tenant for an operation that named tenant, which may be ""
+func (c *TenancyConfig) resolve(tenant string) (string, error) {
+	if tenant == "" {
+		tenant = c.Default
+	}
+	if tenant == "" {
+		return "", ErrNoTenant
+	}
+	if !c.admits(tenant) {
+		return "", fmt.Errorf("%w: %q", ErrUnknownTenant, tenant)
+	}
+	return tenant, nil
+}
+
+// requestTenant returns the tenant a request names, by header or else by
+// subdomain of Domain, or "" if it names none
+func (c *TenancyConfig) requestTenant(r *http.Request) string {
+	if tenant := r.Header.Get(c.header()); tenant != "" {
+		return tenant
+	}
+	if c.Domain == "" {
+		return ""
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	sub, ok := strings.CutSuffix(host, "."+strings.ToLower(c.Domain))
+	if !ok || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// DatabaseFactory builds a complete database stack from config and metrics
+type DatabaseFactory func(config *Config, metrics *Metrics) (Database, error)
+
+// TenantDatabase routes every operation to the database of the tenant in its
+// context, falling back to the default tenant
+// Each tenant gets a stack of its own from the factory - backend, pool,
+// middleware, cache and audit log - with its files under DataDir/tenants/<id>.
+// The pools share one set of MaxConnections slots, so tenants share nothing
+// else but the process. Only configured tenants are served; Initialize opens
+// them all up front.
+type TenantDatabase struct {
+	factory DatabaseFactory
+	logger  *Logger
+	config  *Config
+	metrics *Metrics
+	pool    connectionSlots // shared by the tenants' connection pools
+
+	mu      sync.Mutex // guards tenants and closed, never held while opening one
+	tenants map[string]*tenantEntry
+	closed  bool
+}
+
+// tenantEntry is one tenant's database, opened once however many
+// operations ask for it at the same time
+type tenantEntry struct {
+	once sync.Once
+	db   Database
+	err  error
+}
+
+// errTenantsClosed is returned for tenants asked for after Close
+var errTenantsClosed = errors.New("database is closed")
+
+// NewTenantDatabase creates a router over per-tenant databases built by factory
+func NewTenantDatabase(factory DatabaseFactory, logger *Logger, config *Config, metrics *Metrics) *TenantDatabase {
+	t := &TenantDatabase{
+		factory: factory,
+		logger:  logger,
+		config:  config,
+		metrics: metrics,
+		tenants: make(map[string]*tenantEntry),
+	}
+	if config.Database.MaxConnections > 0 {
+		t.pool = make(connectionSlots, config.Database.MaxConnections)
+	}
+	if metrics != nil {
+		metrics.SetPoolCapacity(config.Database.MaxConnections)
+	}
+	return t
+}
+
+// Initialize opens the configured tenants and the default one
+func (t *TenantDatabase) Initialize(ctx context.Context) error {
+	tenants := slices.Clone(t.config.Tenancy.Tenants)
+	if tenant := t.config.Tenancy.Default; tenant != "" && !slices.Contains(tenants, tenant) {
+		tenants = append(tenants, tenant)
+	}
+	for _, tenant := range tenants {
+		if _, err := t.open(ctx, tenant); err != nil {
+			t.Close(ctx)
+			return err
+		}
+	}
+	t.logger.Log("DATABASE", fmt.Sprintf("Multi-tenant database initialized with %d tenants", len(tenants)))
+	return nil
+}
+
+// Close closes the database of every tenant opened so far, waiting for any
+// still being opened
+func (t *TenantDatabase) Close(ctx context.Context) error {
+	t.mu.Lock()
+	tenants := t.tenants
+	t.tenants = make(map[string]*tenantEntry)
+	t.closed = true
+	t.mu.Unlock()
+
+	var errs []error
+	for tenant, entry := range tenants {
+		// Either waits for the open in progress or keeps it from starting
+		entry.once.Do(func() { entry.err = errTenantsClosed })
+		if entry.db == nil {
+			continue
+		}
+		if err := entry.db.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenant, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tenantConfig derives the configuration of one tenant's database
+// A new tenant's dataset starts empty rather than with the deployment's seed
+// data; it is loaded with the import command instead.
+func (t *TenantDatabase) tenantConfig(tenant string) *Config {
+	config := *t.config
+	config.Database.DataDir = filepath.Join(t.config.Database.storageDir(), "tenants", tenant)
+	config.Database.Fixtures = nil
+	config.Database.EnvironmentFixtures = nil
+	config.Database.StartEmpty = true
+	config.Database.pool = t.pool
+	return &config
+}
+
+// open returns the database of tenant, creating and initializing it if needed
+// Only operations on the same tenant wait while it is opened.
+func (t *TenantDatabase) open(ctx context.Context, tenant string) (Database, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("tenant %s: %w", tenant, errTenantsClosed)
+	}
+	entry, ok := t.tenants[tenant]
+	if !ok {
+		entry = &tenantEntry{}
+		t.tenants[tenant] = entry
+	}
+	t.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.db, entry.err = t.create(ctx, tenant)
+		if entry.err != nil {
+			// Let a later operation try again rather than fail for good
+			t.mu.Lock()
+			if t.tenants[tenant] == entry {
+				delete(t.tenants, tenant)
+			}
+			t.mu.Unlock()
+		}
+	})
+	if entry.err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", tenant, entry.err)
+	}
+	return entry.db, nil
+}
+
+// create builds and initializes the database of tenant
+func (t *TenantDatabase) create(ctx context.Context, tenant string) (Database, error) {
+	var metrics *Metrics
+	if t.metrics != nil {
+		metrics = t.metrics.ForTenant(tenant)
+	}
+	config := t.tenantConfig(tenant)
+	db, err := t.factory(config, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create database: %w", err)
+	}
+	// A tenant opened by a request outlives it
+	if err := db.Initialize(context.WithoutCancel(ctx)); err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	t.logger.Log("DATABASE", fmt.Sprintf("Opened tenant %s in %s", tenant, config.Database.DataDir))
+	return db, nil
+}
+
+// tenantDB returns the database of the tenant an operation belongs to
+func (t *TenantDatabase) tenantDB(ctx context.Context) (Database, error) {
+	tenant, err := t.config.Tenancy.resolve(TenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return t.open(ctx, tenant)
+}
+
+// GetUser looks up a user of the context's tenant
+func (t *TenantDatabase) GetUser(ctx context.Context, id string) (*User, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(ctx, id)
+}
+
+// GetUsers looks up several users of the context's tenant
+func (t *TenantDatabase) GetUsers(ctx context.Context, ids []string) (map[string]*User, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUsers(ctx, ids)
+}
+
+// ListUsers lists the users of the context's tenant
+func (t *TenantDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsers(ctx)
+}
+
+// QueryUsers queries the users of the context's tenant
+func (t *TenantDatabase) QueryUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryUsers(ctx, query)
+}
+
+// CreateUser creates a user for the context's tenant
+func (t *TenantDatabase) CreateUser(ctx context.Context, user *User) (*User, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.CreateUser(ctx, user)
+}
+
+// UpdateUser updates a user of the context's tenant
+func (t *TenantDatabase) UpdateUser(ctx context.Context, user *User) (*User, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.UpdateUser(ctx, user)
+}
+
+// DeleteUser deletes a user of the context's tenant
+func (t *TenantDatabase) DeleteUser(ctx context.Context, id string) error {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return err
+	}
+	return db.DeleteUser(ctx, id)
+}
+
+// Watch streams change events of the context's tenant
+// Sequence numbers are per tenant, so a resume position only applies to the
+// tenant it came from.
+func (t *TenantDatabase) Watch(ctx context.Context, after uint64) (<-chan ChangeEvent, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.Watch(ctx, after)
+}
+
+// History returns the audit trail of a user of the context's tenant
+func (t *TenantDatabase) History(ctx context.Context, id string) ([]AuditEntry, error) {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history, ok := db.(auditHistory)
+	if !ok {
+		return nil, ErrAuditDisabled
+	}
+	return history.History(ctx, id)
+}
+
+// putUser stores user verbatim in the context's tenant
+func (t *TenantDatabase) putUser(ctx context.Context, user *User) error {
+	db, err := t.tenantDB(ctx)
+	if err != nil {
+		return err
+	}
+	return putUser(ctx, db, user)
+}
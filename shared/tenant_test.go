@@ -0,0 +1,237 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantDatabase(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Database.Type = "persistent"
+	config.Tenancy = TenancyConfig{Enabled: true, Tenants: []string{"acme", "globex"}, Default: "acme"}
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	factory := func(config *Config, metrics *Metrics) (Database, error) {
+		return NewCachingDatabase(NewPersistentDatabase(logger, config, metrics), logger, config, metrics), nil
+	}
+	db := NewTenantDatabase(factory, logger, config, metrics)
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+
+	acme := WithTenant(ctx, "acme")
+	globex := WithTenant(ctx, "globex")
+
+	// Tenants start empty and the same ID can exist in each
+	users, err := db.ListUsers(globex)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	_, err = db.CreateUser(acme, NewUser("1", "Acme One"))
+	require.NoError(t, err)
+	_, err = db.CreateUser(globex, NewUser("1", "Globex One"))
+	require.NoError(t, err)
+
+	user, err := db.GetUser(acme, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Acme One", user.Name)
+	user, err = db.GetUser(globex, "1") // not served from acme's cache
+	require.NoError(t, err)
+	assert.Equal(t, "Globex One", user.Name)
+
+	// Without a tenant the default one is used
+	user, err = db.GetUser(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Acme One", user.Name)
+
+	_, err = db.GetUser(WithTenant(ctx, "initech"), "1")
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+
+	// Counters land on the tenant and on the deployment
+	assert.Contains(t, metrics.ForTenant("globex").GetStats(), "Metrics for Tenant globex")
+	acmeMisses, globexMisses := metrics.ForTenant("acme").cacheMisses.Load(), metrics.ForTenant("globex").cacheMisses.Load()
+	assert.Positive(t, globexMisses)
+	assert.Equal(t, acmeMisses+globexMisses, metrics.cacheMisses.Load())
+	assert.NotContains(t, metrics.GetStats(), "globex")
+	assert.Contains(t, metrics.TenantStats(), "  acme: ")
+
+	require.NoError(t, db.Close(ctx))
+	for _, tenant := range []string{"acme", "globex"} {
+		_, err := os.Stat(filepath.Join(config.Database.DataDir, "tenants", tenant, dataFileName))
+		assert.NoError(t, err, tenant)
+	}
+}
+
+func TestTenantMetricsEndpoints(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "t0ken")
+	config := newMiddlewareTestConfig()
+	config.App.Features["admin_api"] = true
+	config.Tenancy = TenancyConfig{Enabled: true, Tenants: []string{"acme", "globex"}}
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	metrics.ForTenant("acme").RecordDBQuery()
+	metrics.ForTenant("globex").RecordDBQuery()
+	server := NewServer(NewUserService(NewMockDatabase(), logger, config, metrics), logger, config, metrics)
+
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Public metrics show the totals or the named tenant, never the others
+	rec := get("/metrics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Queries: 2")
+	assert.NotContains(t, rec.Body.String(), "acme")
+	rec = get("/metrics", "X-Tenant-ID", "acme")
+	assert.Contains(t, rec.Body.String(), "Metrics for Tenant acme")
+	assert.NotContains(t, rec.Body.String(), "globex")
+
+	// The breakdown by tenant is for admins only
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/metrics/tenants").Code)
+	rec = get("/admin/metrics/tenants", "Authorization", "Bearer t0ken")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "  acme: ")
+	assert.Contains(t, rec.Body.String(), "  globex: ")
+}
+
+// blockingDatabase holds ListUsers until release is closed
+type blockingDatabase struct {
+	Database
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingDatabase) ListUsers(ctx context.Context) ([]*User, error) {
+	close(b.entered)
+	<-b.release
+	return nil, nil
+}
+
+func TestTenantSharedPool(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	config.Database.MaxConnections = 1
+	config.Database.PoolWaitTimeout = 10
+	config.Tenancy = TenancyConfig{Enabled: true, Tenants: []string{"acme", "globex"}}
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	acmeDB := &blockingDatabase{Database: NewMockDatabase(), entered: make(chan struct{}), release: make(chan struct{})}
+	factory := func(tenantConfig *Config, metrics *Metrics) (Database, error) {
+		var backend Database = NewMockDatabase()
+		if strings.HasSuffix(tenantConfig.Database.DataDir, "acme") {
+			backend = acmeDB
+		}
+		return NewPooledDatabase(backend, logger, tenantConfig, metrics), nil
+	}
+	db := NewTenantDatabase(factory, logger, config, metrics)
+	ctx := context.Background()
+	require.NoError(t, db.Initialize(ctx))
+	defer db.Close(ctx)
+
+	done := make(chan error)
+	go func() {
+		_, err := db.ListUsers(WithTenant(ctx, "acme"))
+		done <- err
+	}()
+	<-acmeDB.entered
+
+	// max_connections caps the deployment, not each tenant
+	_, err := db.GetUser(WithTenant(ctx, "globex"), "test1")
+	assert.ErrorIs(t, err, ErrPoolExhausted)
+	assert.Contains(t, metrics.GetStats(), "In Use: 1/1")
+
+	close(acmeDB.release)
+	require.NoError(t, <-done)
+	_, err = db.GetUser(WithTenant(ctx, "globex"), "test1")
+	assert.NoError(t, err)
+}
+
+func TestTenantResolution(t *testing.T) {
+	tenancy := TenancyConfig{Enabled: true, Domain: "users.example.com", Tenants: []string{"acme"}}
+
+	_, err := tenancy.resolve("")
+	assert.ErrorIs(t, err, ErrNoTenant)
+	_, err = tenancy.resolve("../etc")
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+	tenant, err := tenancy.resolve("acme")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", tenant)
+	// A well-formed ID still has to be configured
+	_, err = tenancy.resolve("anyone")
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+
+	assert.Error(t, (&TenancyConfig{Enabled: true}).validate())
+	assert.Error(t, (&TenancyConfig{Tenants: []string{"Acme"}}).validate())
+	assert.Error(t, (&TenancyConfig{Tenants: []string{"acme"}, Default: "globex"}).validate())
+}
+
+func TestTenantOpen(t *testing.T) {
+	config := newConcurrencyTestConfig(t)
+	config.Tenancy = TenancyConfig{Enabled: true, Tenants: []string{"acme", "globex"}}
+	logger := NewLogger(config)
+
+	var (
+		mu      sync.Mutex
+		created = make(map[string]int)
+	)
+	release := make(chan struct{})
+	factory := func(tenantConfig *Config, metrics *Metrics) (Database, error) {
+		tenant := filepath.Base(tenantConfig.Database.DataDir)
+		mu.Lock()
+		created[tenant]++
+		mu.Unlock()
+		if tenant == "globex" {
+			<-release
+		}
+		return NewInMemoryDatabase(logger, tenantConfig, metrics), nil
+	}
+	db := NewTenantDatabase(factory, logger, config, nil)
+	ctx := context.Background()
+
+	// While globex is still opening, acme is served
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.ListUsers(WithTenant(ctx, "globex"))
+			assert.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return created["globex"] == 1
+	}, time.Second, time.Millisecond)
+	_, err := db.ListUsers(WithTenant(ctx, "acme"))
+	require.NoError(t, err)
+	close(release)
+	wg.Wait()
+
+	// However many operations asked at once, each tenant was opened once
+	assert.Equal(t, map[string]int{"acme": 1, "globex": 1}, created)
+
+	// Without an audit log, history says so instead of coming back empty
+	_, err = db.History(WithTenant(ctx, "acme"), "1")
+	assert.ErrorIs(t, err, ErrAuditDisabled)
+
+	require.NoError(t, db.Close(ctx))
+	_, err = db.ListUsers(WithTenant(ctx, "acme"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,438 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dataset formats accepted by ExportUsers and ImportUsers
+const (
+	FormatJSON   = "json"   // A single JSON array of users
+	FormatNDJSON = "ndjson" // One JSON user per line
+	FormatCSV    = "csv"    // Header row, attributes as a JSON object column
+)
+
+// Conflict policies for importing a user whose ID already exists
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// Errors returned by ExportUsers and ImportUsers
+var (
+	ErrInvalidDataset = errors.New("invalid dataset")
+	ErrImportConflict = errors.New("user already exists in target database")
+)
+
+// importBatchSize is how many records are checked for conflicts in one lookup
+const importBatchSize = 100
+
+// csvHeader is the column order written and expected for CSV datasets
+var csvHeader = []string{"id", "name", "email", "created_at", "updated_at", "attributes"}
+
+// validFormat reports whether format is a known dataset format
+func validFormat(format string) bool {
+	switch format {
+	case FormatJSON, FormatNDJSON, FormatCSV:
+		return true
+	}
+	return false
+}
+
+// FormatFromPath guesses a dataset format from a file extension
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".csv":
+		return FormatCSV
+	default:
+		return FormatJSON
+	}
+}
+
+// ExportUsers writes every user to w in the given format, ordered by ID
+// Users are read a page at a time, so large datasets are never held in memory.
+func ExportUsers(ctx context.Context, db Database, w io.Writer, format string) (int, error) {
+	if !validFormat(format) {
+		return 0, fmt.Errorf("%w: unsupported format %q, expected json, ndjson or csv", ErrInvalidDataset, format)
+	}
+
+	bw := bufio.NewWriter(w)
+	var csvw *csv.Writer
+	switch format {
+	case FormatJSON:
+		bw.WriteString("[")
+	case FormatCSV:
+		csvw = csv.NewWriter(bw)
+		csvw.Write(csvHeader)
+	}
+
+	count := 0
+	query := UserQuery{Limit: MaxQueryLimit}
+	for {
+		page, err := db.QueryUsers(ctx, query)
+		if err != nil {
+			return count, err
+		}
+		for _, user := range page.Users {
+			if err := writeUser(bw, csvw, format, user, count); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	switch format {
+	case FormatJSON:
+		if count > 0 {
+			bw.WriteString("\n")
+		}
+		bw.WriteString("]\n")
+	case FormatCSV:
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return count, err
+		}
+	}
+	return count, bw.Flush()
+}
+
+// writeUser encodes one user; index is its position in the export
+func writeUser(bw *bufio.Writer, csvw *csv.Writer, format string, user *User, index int) error {
+	if format == FormatCSV {
+		attributes := ""
+		if len(user.Attributes) > 0 {
+			data, err := json.Marshal(user.Attributes)
+			if err != nil {
+				return err
+			}
+			attributes = string(data)
+		}
+		return csvw.Write([]string{
+			user.ID, user.Name, user.Email,
+			user.CreatedAt.Format(time.RFC3339Nano), user.UpdatedAt.Format(time.RFC3339Nano),
+			attributes,
+		})
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if format == FormatJSON && index > 0 {
+		bw.WriteString(",")
+	}
+	if format == FormatJSON {
+		bw.WriteString("\n  ")
+	}
+	bw.Write(data)
+	if format == FormatNDJSON {
+		bw.WriteString("\n")
+	}
+	return nil
+}
+
+// ImportOptions controls ImportUsers
+type ImportOptions struct {
+	Format   string
+	Conflict string // skip (default), overwrite or fail
+	DryRun   bool   // Validate and report without writing anything
+}
+
+// ImportError describes a record that could not be imported
+type ImportError struct {
+	Record int    `json:"record"` // 1-based position in the input
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ImportResult summarizes an import; in a dry run the counts are what would happen
+type ImportResult struct {
+	DryRun  bool          `json:"dry_run"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped int           `json:"skipped"`
+	Errors  []ImportError `json:"errors,omitempty"`
+
+	// Why the import stopped early; the counts cover what was written before
+	Error string `json:"error,omitempty"`
+}
+
+// importRecord is one decoded input record
+type importRecord struct {
+	index int
+	user  *User
+	err   error
+}
+
+// ImportUsers reads users from r and writes them to db
+// Input is decoded as a stream and applied in batches. Invalid records are
+// reported and skipped. Existing IDs are handled by the conflict policy; with
+// fail, the import stops before writing the batch holding the first conflict,
+// so run a dry run first to check a dataset without partial imports. When
+// the import stops early, the result still reports what was written.
+// Timestamps in the input are ignored; the target database assigns its own.
+func ImportUsers(ctx context.Context, db Database, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	if !validFormat(opts.Format) {
+		return nil, fmt.Errorf("%w: unsupported format %q, expected json, ndjson or csv", ErrInvalidDataset, opts.Format)
+	}
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = ConflictSkip
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+	default:
+		return nil, fmt.Errorf("%w: unsupported conflict policy %q, expected skip, overwrite or fail", ErrInvalidDataset, opts.Conflict)
+	}
+
+	result := &ImportResult{DryRun: opts.DryRun}
+	seen := make(map[string]int) // ID -> record that first used it
+	batch := make([]importRecord, 0, importBatchSize)
+
+	flush := func() error {
+		err := applyBatch(ctx, db, batch, opts, result)
+		batch = batch[:0]
+		return err
+	}
+
+	err := decodeUsers(r, opts.Format, func(rec importRecord) error {
+		if rec.err == nil {
+			rec.err = validateImport(rec.user)
+		}
+		if rec.err == nil {
+			if first, ok := seen[rec.user.ID]; ok {
+				rec.err = fmt.Errorf("duplicate of record %d", first)
+			} else {
+				seen[rec.user.ID] = rec.index
+			}
+		}
+		if rec.err != nil {
+			result.Errors = append(result.Errors, importError(rec))
+			return nil
+		}
+
+		batch = append(batch, rec)
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Record < result.Errors[j].Record
+	})
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// validateImport checks the fields every user must have
+func validateImport(user *User) error {
+	if user.ID == "" {
+		return errors.New("missing id")
+	}
+	if user.Name == "" {
+		return errors.New("missing name")
+	}
+	return nil
+}
+
+// importError converts a failed record into a reportable error
+func importError(rec importRecord) ImportError {
+	e := ImportError{Record: rec.index, Error: rec.err.Error()}
+	if rec.user != nil {
+		e.ID = rec.user.ID
+	}
+	return e
+}
+
+// applyBatch resolves conflicts for a batch with one lookup, then writes it
+func applyBatch(ctx context.Context, db Database, batch []importRecord, opts ImportOptions, result *ImportResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(batch))
+	for i, rec := range batch {
+		ids[i] = rec.user.ID
+	}
+	existing, err := db.GetUsers(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	if opts.Conflict == ConflictFail {
+		for _, rec := range batch {
+			if _, ok := existing[rec.user.ID]; ok {
+				result.Errors = append(result.Errors, importError(importRecord{index: rec.index, user: rec.user, err: ErrImportConflict}))
+				if opts.DryRun {
+					continue
+				}
+				return fmt.Errorf("record %d (%s): %w", rec.index, rec.user.ID, ErrImportConflict)
+			}
+		}
+	}
+
+	for _, rec := range batch {
+		_, exists := existing[rec.user.ID]
+		switch {
+		case exists && opts.Conflict == ConflictSkip:
+			result.Skipped++
+			continue
+		case exists && opts.Conflict == ConflictFail:
+			// Only reached in a dry run; already reported above
+			continue
+		}
+		if opts.DryRun {
+			if exists {
+				result.Updated++
+			} else {
+				result.Created++
+			}
+			continue
+		}
+
+		if exists {
+			// Overwrites replace whatever is stored, whichever version it is
+			rec.user.Version = 0
+			_, err = db.UpdateUser(ctx, rec.user)
+		} else {
+			_, err = db.CreateUser(ctx, rec.user)
+		}
+		switch {
+		case err == nil && exists:
+			result.Updated++
+		case err == nil:
+			result.Created++
+		case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrUserExists):
+			// Changed by someone else since the lookup
+			result.Errors = append(result.Errors, importError(importRecord{index: rec.index, user: rec.user, err: err}))
+		default:
+			return fmt.Errorf("record %d (%s): %w", rec.index, rec.user.ID, err)
+		}
+	}
+	return nil
+}
+
+// decodeUsers streams records from r to handle in input order
+// A record that can't be decoded is passed on with its error; input that
+// can't be parsed any further ends decoding with an error.
+func decodeUsers(r io.Reader, format string, handle func(importRecord) error) error {
+	switch format {
+	case FormatNDJSON:
+		return decodeNDJSON(r, handle)
+	case FormatCSV:
+		return decodeCSV(r, handle)
+	default:
+		return decodeJSON(r, handle)
+	}
+}
+
+func decodeJSON(r io.Reader, handle func(importRecord) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("%w: expected a json array of users", ErrInvalidDataset)
+	}
+	for index := 1; dec.More(); index++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("%w: json record %d: %w", ErrInvalidDataset, index, err)
+		}
+		rec := importRecord{index: index, user: &User{}}
+		rec.err = json.Unmarshal(raw, rec.user)
+		if err := handle(rec); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDataset, err)
+	}
+	return nil
+}
+
+func decodeNDJSON(r io.Reader, handle func(importRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for index := 0; scanner.Scan(); {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		index++
+		rec := importRecord{index: index, user: &User{}}
+		rec.err = json.Unmarshal([]byte(line), rec.user)
+		if err := handle(rec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDataset, err)
+	}
+	return nil
+}
+
+func decodeCSV(r io.Reader, handle func(importRecord) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%w: missing csv header: %v", ErrInvalidDataset, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"id", "name"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("%w: missing csv column %q", ErrInvalidDataset, required)
+		}
+	}
+
+	for index := 1; ; index++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: csv record %d: %w", ErrInvalidDataset, index, err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		rec := importRecord{index: index, user: &User{
+			ID:    field("id"),
+			Name:  field("name"),
+			Email: field("email"),
+		}}
+		if attributes := field("attributes"); attributes != "" {
+			if err := json.Unmarshal([]byte(attributes), &rec.user.Attributes); err != nil {
+				rec.err = fmt.Errorf("invalid attributes: %w", err)
+			}
+		}
+		if err := handle(rec); err != nil {
+			return err
+		}
+	}
+}
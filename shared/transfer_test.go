@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	ctx := context.Background()
+
+	source := NewInMemoryDatabase(logger, config, metrics)
+	user := NewUser("42", "Dana, \"the\" Dev")
+	user.Email = "dana@example.com"
+	user.Attributes = map[string]string{"team": "core"}
+	_, err := source.CreateUser(ctx, user)
+	require.NoError(t, err)
+
+	for _, format := range []string{FormatJSON, FormatNDJSON, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			count, err := ExportUsers(ctx, source, &buf, format)
+			require.NoError(t, err)
+			assert.Equal(t, 4, count)
+
+			// The target already has the seed users, so only 42 is new
+			target := NewInMemoryDatabase(logger, config, metrics)
+			result, err := ImportUsers(ctx, target, &buf, ImportOptions{Format: format})
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.Created)
+			assert.Equal(t, 3, result.Skipped)
+			assert.Empty(t, result.Errors)
+
+			imported, err := target.GetUser(ctx, "42")
+			require.NoError(t, err)
+			assert.Equal(t, user.Name, imported.Name)
+			assert.Equal(t, user.Email, imported.Email)
+			assert.Equal(t, user.Attributes, imported.Attributes)
+		})
+	}
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	ctx := context.Background()
+	input := `{"id":"9","name":"Ivy"}
+{"id":"1","name":"Renamed"}
+{"id":"","name":"Nobody"}
+not json
+`
+
+	db := NewInMemoryDatabase(logger, config, metrics)
+	result, err := ImportUsers(ctx, db, strings.NewReader(input), ImportOptions{Format: FormatNDJSON, Conflict: ConflictFail, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	require.Len(t, result.Errors, 3)
+	assert.Equal(t, "1", result.Errors[0].ID)
+	_, err = db.GetUser(ctx, "9")
+	assert.ErrorIs(t, err, ErrUserNotFound, "dry run must not write")
+
+	// Fail stops before writing the batch that holds the conflict
+	_, err = ImportUsers(ctx, db, strings.NewReader(input), ImportOptions{Format: FormatNDJSON, Conflict: ConflictFail})
+	assert.ErrorIs(t, err, ErrImportConflict)
+	_, err = db.GetUser(ctx, "9")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	result, err = ImportUsers(ctx, db, strings.NewReader(input), ImportOptions{Format: FormatNDJSON, Conflict: ConflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Updated)
+	renamed, err := db.GetUser(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", renamed.Name)
+
+	_, err = ImportUsers(ctx, db, strings.NewReader("{"), ImportOptions{Format: FormatJSON})
+	assert.ErrorIs(t, err, ErrInvalidDataset)
+}
+
+func TestImportStopsWithPartialResult(t *testing.T) {
+	ctx := context.Background()
+	db := NewMockDatabase()
+
+	// The first batch is written before the input turns out to be truncated
+	var input strings.Builder
+	input.WriteString("[")
+	for i := 0; i < importBatchSize; i++ {
+		fmt.Fprintf(&input, `{"id":"user-%d","name":"User"},`, i)
+	}
+	input.WriteString(`{"id":"cut`)
+
+	result, err := ImportUsers(ctx, db, strings.NewReader(input.String()), ImportOptions{Format: FormatJSON})
+	assert.ErrorIs(t, err, ErrInvalidDataset)
+	require.NotNil(t, result)
+	assert.Equal(t, importBatchSize, result.Created)
+	assert.Equal(t, err.Error(), result.Error)
+	assert.Len(t, db.Users, importBatchSize+3)
+}
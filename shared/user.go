@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// User is the record stored by every Database implementation
+type User struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Email      string            `json:"email,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Version    uint64            `json:"version"` // Starts at 1 and increases with every update
+}
+
+// NewUser creates a user with both timestamps set to now
+func NewUser(id, name string) *User {
+	now := time.Now().UTC()
+	return &User{
+		ID:        id,
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+}
+
+// Clone returns a deep copy so callers can't mutate stored records
+func (u *User) Clone() *User {
+	if u == nil {
+		return nil
+	}
+	clone := *u
+	if u.Attributes != nil {
+		clone.Attributes = make(map[string]string, len(u.Attributes))
+		for k, v := range u.Attributes {
+			clone.Attributes[k] = v
+		}
+	}
+	return &clone
+}
+
+// stampCreate fills in timestamps for a newly created record
+func stampCreate(user *User) *User {
+	stored := user.Clone()
+	now := time.Now().UTC()
+	stored.CreatedAt = now
+	stored.UpdatedAt = now
+	stored.Version = 1
+	return stored
+}
+
+// stampUpdate carries over the creation time from the existing record and
+// moves to the next version
+func stampUpdate(existing, user *User) *User {
+	stored := user.Clone()
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now().UTC()
+	stored.Version = existing.Version + 1
+	return stored
+}
+
+// checkVersion rejects an update whose expected version is stale
+// A zero Version on the update means "whatever is stored". With a CreatedAt
+// it only matches the same incarnation of the user, not one recreated since.
+func checkVersion(existing, user *User) error {
+	if user.Version == 0 {
+		return nil
+	}
+	if user.Version != existing.Version {
+		return fmt.Errorf("%w: user %s is at version %d, not %d",
+			ErrVersionConflict, user.ID, existing.Version, user.Version)
+	}
+	if !user.CreatedAt.IsZero() && !user.CreatedAt.Equal(existing.CreatedAt) {
+		return fmt.Errorf("%w: user %s was deleted and created again", ErrVersionConflict, user.ID)
+	}
+	return nil
+}
+
+// sortUsers orders users by ID for stable listings
+func sortUsers(users []*User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+}
@@ -0,0 +1,264 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors returned by QueryUsers
+var (
+	ErrInvalidQuery  = errors.New("invalid user query")
+	ErrInvalidCursor = errors.New("invalid or tampered cursor")
+)
+
+// Fields UserQuery.SortBy accepts
+const (
+	SortByID        = "id"
+	SortByName      = "name"
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+)
+
+const (
+	// DefaultQueryLimit applies when UserQuery.Limit is unset
+	DefaultQueryLimit = 50
+	// MaxQueryLimit is the largest page QueryUsers returns
+	MaxQueryLimit = 500
+)
+
+// UserQuery filters, orders and pages through users
+// Name filters are case-insensitive. Cursor is the NextCursor of a previous
+// page and is only valid with the same filters and sort order.
+type UserQuery struct {
+	NamePrefix   string
+	NameContains string
+	SortBy       string // id (default), name, created_at or updated_at
+	Desc         bool
+	Limit        int
+	Cursor       string
+}
+
+// UserPage is one page of query results
+type UserPage struct {
+	Users      []*User `json:"users"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// normalize fills in defaults and rejects unknown sort fields or bad limits
+func (q UserQuery) normalize() (UserQuery, error) {
+	if q.SortBy == "" {
+		q.SortBy = SortByID
+	}
+	switch q.SortBy {
+	case SortByID, SortByName, SortByCreatedAt, SortByUpdatedAt:
+	default:
+		return q, fmt.Errorf("%w: unknown sort field %q", ErrInvalidQuery, q.SortBy)
+	}
+	if q.Limit < 0 {
+		return q, fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	if q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+	q.NamePrefix = strings.ToLower(q.NamePrefix)
+	q.NameContains = strings.ToLower(q.NameContains)
+	return q, nil
+}
+
+// matches reports whether user passes the name filters
+func (q UserQuery) matches(user *User) bool {
+	name := strings.ToLower(user.Name)
+	return strings.HasPrefix(name, q.NamePrefix) && strings.Contains(name, q.NameContains)
+}
+
+// sortKey returns the value user is ordered by; times use a fixed-width
+// layout so that comparing keys as strings orders them chronologically
+func (q UserQuery) sortKey(user *User) string {
+	switch q.SortBy {
+	case SortByName:
+		return strings.ToLower(user.Name)
+	case SortByCreatedAt:
+		return user.CreatedAt.UTC().Format(sortTimeLayout)
+	case SortByUpdatedAt:
+		return user.UpdatedAt.UTC().Format(sortTimeLayout)
+	default:
+		return user.ID
+	}
+}
+
+const sortTimeLayout = "20060102T150405.000000000"
+
+// position is a point in the result order; ties on the sort key break by ID
+type position struct {
+	Key string `json:"k"`
+	ID  string `json:"i"`
+}
+
+// before reports whether a sorts ahead of b in the query's order
+func (q UserQuery) before(a, b position) bool {
+	if q.Desc {
+		a, b = b, a
+	}
+	return a.Key < b.Key || (a.Key == b.Key && a.ID < b.ID)
+}
+
+// fingerprint identifies the filters and order a cursor belongs to
+func (q UserQuery) fingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		q.NamePrefix, q.NameContains, q.SortBy, strconv.FormatBool(q.Desc),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// cursorPayload is the signed content of a cursor
+type cursorPayload struct {
+	After position `json:"a"`
+	Query string   `json:"q"`
+}
+
+// processCursorKey signs cursors when no cursor_secret is configured
+// Such cursors stop working after a restart.
+var processCursorKey = sync.OnceValue(func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generating cursor key: %v", err))
+	}
+	return key
+})
+
+// cursorCodec signs and verifies pagination cursors with HMAC-SHA256
+type cursorCodec struct {
+	key []byte
+}
+
+// newCursorCodec uses the configured secret, or a random per-process key
+func newCursorCodec(config *DatabaseConfig) *cursorCodec {
+	if config.CursorSecret != "" {
+		return &cursorCodec{key: []byte(config.CursorSecret)}
+	}
+	return &cursorCodec{key: processCursorKey()}
+}
+
+// encode returns an opaque cursor resuming q after the given position
+func (c *cursorCodec) encode(q UserQuery, after position) string {
+	payload, _ := json.Marshal(cursorPayload{After: after, Query: q.fingerprint()})
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decode verifies cursor and returns the position it resumes after
+func (c *cursorCodec) decode(q UserQuery, cursor string) (position, error) {
+	data, sig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return position{}, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return position{}, ErrInvalidCursor
+	}
+
+	var p cursorPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return position{}, ErrInvalidCursor
+	}
+	if p.Query != q.fingerprint() {
+		return position{}, fmt.Errorf("%w: cursor belongs to a different query", ErrInvalidCursor)
+	}
+	return p.After, nil
+}
+
+// queryUsers applies q to candidates and returns the requested page
+// Candidates may be stored records: they are only read, and just the users
+// on the page are cloned.
+func queryUsers(candidates []*User, q UserQuery, codec *cursorCodec) (*UserPage, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var after *position
+	if q.Cursor != "" {
+		p, err := codec.decode(q, q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &p
+	}
+
+	type entry struct {
+		pos  position
+		user *User
+	}
+	matched := make([]entry, 0, len(candidates))
+	for _, user := range candidates {
+		if !q.matches(user) {
+			continue
+		}
+		pos := position{Key: q.sortKey(user), ID: user.ID}
+		if after != nil && !q.before(*after, pos) {
+			continue
+		}
+		matched = append(matched, entry{pos: pos, user: user})
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.before(matched[i].pos, matched[j].pos)
+	})
+
+	page := &UserPage{Users: make([]*User, 0, min(q.Limit, len(matched)))}
+	for _, e := range matched[:min(q.Limit, len(matched))] {
+		page.Users = append(page.Users, e.user.Clone())
+	}
+	if len(matched) > q.Limit {
+		page.NextCursor = codec.encode(q, matched[q.Limit-1].pos)
+	}
+	return page, nil
+}
+
+// mergePages combines pages that each answered the same query over a
+// disjoint part of the data into a single page
+func mergePages(pages []*UserPage, q UserQuery, codec *cursorCodec) (*UserPage, error) {
+	var users []*User
+	more := false
+	for _, page := range pages {
+		users = append(users, page.Users...)
+		more = more || page.NextCursor != ""
+	}
+
+	// Each page already starts after the cursor
+	q.Cursor = ""
+	merged, err := queryUsers(users, q, codec)
+	if err != nil {
+		return nil, err
+	}
+	if merged.NextCursor == "" && more && len(merged.Users) > 0 {
+		nq, _ := q.normalize()
+		last := merged.Users[len(merged.Users)-1]
+		merged.NextCursor = codec.encode(nq, position{Key: nq.sortKey(last), ID: last.ID})
+	}
+	return merged, nil
+}
@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectPages follows cursors until the last page and returns every user ID
+func collectPages(t *testing.T, db Database, query UserQuery) []string {
+	t.Helper()
+	var ids []string
+	for {
+		page, err := db.QueryUsers(context.Background(), query)
+		require.NoError(t, err)
+		for _, user := range page.Users {
+			ids = append(ids, user.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func TestQueryUsers(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+
+	inmemory := NewInMemoryDatabase(logger, config, metrics)
+	sharded := newShardedDatabase([]Database{
+		NewInMemoryDatabase(logger, config, metrics),
+		NewInMemoryDatabase(logger, config, metrics),
+	}, logger, config, metrics)
+
+	ctx := context.Background()
+	for _, db := range []Database{inmemory, sharded} {
+		require.NoError(t, db.Initialize(ctx))
+		defer db.Close(ctx)
+		for i, name := range []string{"Anna", "annabel", "Bert", "Hannah", "Zed"} {
+			_, err := db.CreateUser(ctx, NewUser(fmt.Sprintf("u%d", i), name))
+			require.NoError(t, err)
+		}
+	}
+
+	for name, db := range map[string]Database{"inmemory": inmemory, "sharded": sharded} {
+		t.Run(name, func(t *testing.T) {
+			// Small pages walk every user exactly once, in order
+			ids := collectPages(t, db, UserQuery{Limit: 2})
+			assert.Equal(t, []string{"1", "2", "3", "u0", "u1", "u2", "u3", "u4"}, ids)
+
+			ids = collectPages(t, db, UserQuery{NamePrefix: "AN", SortBy: SortByName, Limit: 1})
+			assert.Equal(t, []string{"u0", "u1"}, ids)
+
+			ids = collectPages(t, db, UserQuery{NameContains: "an", SortBy: SortByName, Desc: true, Limit: 2})
+			assert.Equal(t, []string{"u3", "u1", "u0"}, ids)
+
+			_, err := db.QueryUsers(ctx, UserQuery{SortBy: "email"})
+			assert.ErrorIs(t, err, ErrInvalidQuery)
+		})
+	}
+
+	// Cursors can't be forged or reused with a different query
+	page, err := inmemory.QueryUsers(ctx, UserQuery{Limit: 1})
+	require.NoError(t, err)
+	require.NotEmpty(t, page.NextCursor)
+
+	_, err = inmemory.QueryUsers(ctx, UserQuery{Limit: 1, Cursor: page.NextCursor + "x"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = inmemory.QueryUsers(ctx, UserQuery{Limit: 1, Cursor: page.NextCursor, Desc: true})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestConfigEndpointHidesCursorSecret(t *testing.T) {
+	config := newMiddlewareTestConfig()
+	config.Database.CursorSecret = "s3cret-cursor-key"
+	logger := NewLogger(config)
+	metrics := NewMetrics(config)
+	db := NewInMemoryDatabase(logger, config, metrics)
+	server := NewServer(NewUserService(db, logger, config, metrics), logger, config, metrics)
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "s3cret-cursor-key")
+
+	// Cursors are still signed with the configured secret
+	assert.Equal(t, "s3cret-cursor-key", config.Database.CursorSecret)
+}
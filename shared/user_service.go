@@ -1,8 +1,14 @@
 package shared
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -14,6 +20,8 @@ type UserService struct {
 	logger       *Logger
 	metrics      *Metrics
 	rateLimiting bool
+	maxImport    int64      // request body limit for imports
+	mu           sync.Mutex // guards lastRequest across concurrent requests
 	lastRequest  time.Time
 }
 
@@ -26,6 +34,7 @@ func NewUserService(db Database, logger *Logger, config *Config, metrics *Metric
 		logger:       logger,
 		metrics:      metrics,
 		rateLimiting: config.App.Features["rate_limiting"],
+		maxImport:    config.App.maxImportBytes(),
 	}
 }
 
@@ -34,13 +43,18 @@ func (s *UserService) GetUserHandler(c echo.Context) error {
 	// Simple rate limiting if enabled
 	if s.rateLimiting {
 		now := time.Now()
-		if s.lastRequest.Add(100 * time.Millisecond).After(now) {
+		s.mu.Lock()
+		limited := s.lastRequest.Add(100 * time.Millisecond).After(now)
+		if !limited {
+			s.lastRequest = now
+		}
+		s.mu.Unlock()
+		if limited {
 			s.logger.Log("USER", "Rate limit exceeded")
 			return c.String(http.StatusTooManyRequests, "Too many requests")
 		}
-		s.lastRequest = now
 	}
-	
+
 	userID := c.QueryParam("id")
 	if userID == "" {
 		s.logger.Log("USER", "Missing user ID in request")
@@ -51,13 +65,502 @@ func (s *UserService) GetUserHandler(c echo.Context) error {
 	if s.metrics != nil {
 		s.metrics.RecordUserLookup()
 	}
-	
-	user, err := s.db.GetUser(userID)
+
+	user, err := s.db.GetUser(c.Request().Context(), userID)
 	if err != nil {
 		s.logger.Log("USER", fmt.Sprintf("Error fetching user: %v", err))
-		return c.String(http.StatusNotFound, "User not found")
+		return s.errorResponse(c, err)
+	}
+
+	etag := userETag(user)
+	c.Response().Header().Set("ETag", etag)
+	if match := c.Request().Header.Get("If-Match"); match != "" && !etagMatches(match, etag, false) {
+		return c.String(http.StatusPreconditionFailed, "User has changed")
+	}
+	if match := c.Request().Header.Get("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Successfully fetched user: %s", user.Name))
+	// Existing clients read the plain-text line; the full record is opt-in
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusOK, user)
+	}
+	return c.String(http.StatusOK, fmt.Sprintf("User: %s\n", user.Name))
+}
+
+// userETag is the entity tag of a user's current version
+// Versions start over when a user is deleted and created again, so the tag
+// also carries the creation time to tell the two records apart.
+func userETag(user *User) string {
+	return `"` + strconv.FormatUint(user.Version, 10) + "-" + strconv.FormatInt(user.CreatedAt.UnixNano(), 36) + `"`
+}
+
+// parseUserETag returns the version and creation time a tag from userETag names
+func parseUserETag(tag string) (uint64, time.Time, bool) {
+	tag, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	version, created, ok := strings.Cut(tag, "-")
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	n, err := strconv.ParseUint(version, 10, 64)
+	if err != nil || n == 0 {
+		return 0, time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(created, 36, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return n, time.Unix(0, nanos).UTC(), true
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// matches etag. If-None-Match uses weak comparison, so W/ prefixes are ignored;
+// If-Match uses strong comparison, which a weak tag never passes.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// expectVersion pins update to the version named by the If-Match header of a
+// write, leaving it unpinned without a precondition. A single tag is checked
+// atomically by the database, a list against the current record first.
+func (s *UserService) expectVersion(c echo.Context, update *User) error {
+	match := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if match == "" || match == "*" {
+		return nil
+	}
+	if !strings.Contains(match, ",") {
+		version, created, ok := parseUserETag(match)
+		if !ok {
+			// Not a tag this server issued, so it can't match
+			return ErrVersionConflict
+		}
+		update.Version, update.CreatedAt = version, created
+		return nil
+	}
+
+	current, err := s.db.GetUser(c.Request().Context(), update.ID)
+	if err != nil {
+		return err
+	}
+	if !etagMatches(match, userETag(current), false) {
+		return ErrVersionConflict
+	}
+	update.Version, update.CreatedAt = current.Version, current.CreatedAt
+	return nil
+}
+
+// userRequest is the JSON body accepted by the user write endpoints
+// Timestamps are managed by the database and ignored on input
+type userRequest struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Email      string            `json:"email"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// toUser converts the request body into a User record
+func (r *userRequest) toUser() *User {
+	return &User{
+		ID:         r.ID,
+		Name:       r.Name,
+		Email:      r.Email,
+		Attributes: r.Attributes,
+	}
+}
+
+// maxBatchSize caps the number of IDs in one batch lookup
+const maxBatchSize = 100
+
+// batchResult is the outcome of one ID in a batch lookup
+type batchResult struct {
+	ID    string `json:"id"`
+	User  *User  `json:"user,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// queryParams are the GET /users parameters that switch to a paged search
+var queryParams = []string{"limit", "cursor", "prefix", "q", "sort", "order"}
+
+// ListUsersHandler returns every stored user, the users named by ?ids=1,2,3,
+// or a page of search results when any query parameter is given
+func (s *UserService) ListUsersHandler(c echo.Context) error {
+	if ids := c.QueryParam("ids"); ids != "" {
+		return s.getUsersBatch(c, ids)
+	}
+	for _, param := range queryParams {
+		if c.QueryParams().Has(param) {
+			return s.queryUsers(c)
+		}
+	}
+
+	users, err := s.db.ListUsers(c.Request().Context())
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error listing users: %v", err))
+		return s.errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+// queryUsers serves one page of a filtered, sorted user listing
+func (s *UserService) queryUsers(c echo.Context) error {
+	query := UserQuery{
+		NamePrefix:   c.QueryParam("prefix"),
+		NameContains: c.QueryParam("q"),
+		SortBy:       c.QueryParam("sort"),
+		Cursor:       c.QueryParam("cursor"),
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return c.String(http.StatusBadRequest, "Invalid order: expected asc or desc")
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return c.String(http.StatusBadRequest, "Invalid limit")
+		}
+		query.Limit = n
+	}
+
+	page, err := s.db.QueryUsers(c.Request().Context(), query)
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error querying users: %v", err))
+		return s.errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// getUsersBatch looks up a comma-separated list of IDs in a single query
+// Results keep the requested order, with an error entry for each missing ID
+func (s *UserService) getUsersBatch(c echo.Context, param string) error {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(param, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return c.String(http.StatusBadRequest, "Missing user IDs")
+	}
+	if len(ids) > maxBatchSize {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Too many user IDs (max %d)", maxBatchSize))
+	}
+
+	if s.metrics != nil {
+		for range ids {
+			s.metrics.RecordUserLookup()
+		}
+	}
+
+	users, err := s.db.GetUsers(c.Request().Context(), ids)
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error fetching users: %v", err))
+		return s.errorResponse(c, err)
 	}
 
-	s.logger.Log("USER", fmt.Sprintf("Successfully fetched user: %s", user))
-	return c.String(http.StatusOK, fmt.Sprintf("User: %s\n", user))
+	results := make([]batchResult, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := users[id]; ok {
+			results = append(results, batchResult{ID: id, User: user})
+		} else {
+			results = append(results, batchResult{ID: id, Error: ErrUserNotFound.Error()})
+		}
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Fetched %d of %d users", len(users), len(ids)))
+	return c.JSON(http.StatusOK, results)
+}
+
+// CreateUserHandler creates a new user from a JSON body
+func (s *UserService) CreateUserHandler(c echo.Context) error {
+	var req userRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.ID == "" || req.Name == "" {
+		s.logger.Log("USER", "Missing user ID or name in create request")
+		return c.String(http.StatusBadRequest, "Missing user ID or name")
+	}
+
+	user, err := s.db.CreateUser(c.Request().Context(), req.toUser())
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error creating user: %v", err))
+		return s.errorResponse(c, err)
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Created user: %s", user.ID))
+	c.Response().Header().Set("ETag", userETag(user))
+	return c.JSON(http.StatusCreated, user)
+}
+
+// UpdateUserHandler replaces the user identified by the :id path parameter
+// With an If-Match header the update only applies to that version of the user.
+func (s *UserService) UpdateUserHandler(c echo.Context) error {
+	var req userRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.Name == "" {
+		s.logger.Log("USER", "Missing name in update request")
+		return c.String(http.StatusBadRequest, "Missing user name")
+	}
+
+	// The path parameter always wins over any ID in the body
+	req.ID = c.Param("id")
+
+	update := req.toUser()
+	if err := s.expectVersion(c, update); err != nil {
+		return s.errorResponse(c, err)
+	}
+
+	user, err := s.db.UpdateUser(c.Request().Context(), update)
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error updating user: %v", err))
+		return s.errorResponse(c, err)
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Updated user: %s", user.ID))
+	c.Response().Header().Set("ETag", userETag(user))
+	return c.JSON(http.StatusOK, user)
+}
+
+// DeleteUserHandler removes the user identified by the :id path parameter
+func (s *UserService) DeleteUserHandler(c echo.Context) error {
+	id := c.Param("id")
+	if err := s.db.DeleteUser(c.Request().Context(), id); err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error deleting user: %v", err))
+		return s.errorResponse(c, err)
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Deleted user: %s", id))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UserHistoryHandler returns the audit trail of the user identified by the
+// :id path parameter, oldest change first
+func (s *UserService) UserHistoryHandler(c echo.Context) error {
+	history, ok := s.db.(auditHistory)
+	if !ok {
+		return s.errorResponse(c, ErrAuditDisabled)
+	}
+
+	id := c.Param("id")
+	entries, err := history.History(c.Request().Context(), id)
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error reading history: %v", err))
+		return s.errorResponse(c, err)
+	}
+	if len(entries) == 0 {
+		return c.String(http.StatusNotFound, "No history for user")
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// sseKeepAlive is how often an idle event stream sends a comment line, so
+// proxies don't close it and dead clients are noticed
+const sseKeepAlive = 15 * time.Second
+
+// WatchUsersHandler streams user changes as Server-Sent Events
+// Clients resume after a reconnect with the Last-Event-ID header (or ?since=).
+// A client that falls behind is sent a "reset" event and disconnected; it
+// should reconnect with the last ID it processed.
+func (s *UserService) WatchUsersHandler(c echo.Context) error {
+	lastID := c.Request().Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.QueryParam("since")
+	}
+	var after uint64
+	if lastID != "" {
+		n, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid event ID")
+		}
+		after = n
+	}
+
+	ctx := c.Request().Context()
+	events, err := s.db.Watch(ctx, after)
+	if errors.Is(err, ErrEventsExpired) {
+		// The client must reload its state and watch from now
+		return c.String(http.StatusGone, "Events no longer available, reload and reconnect without an ID")
+	}
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Error watching users: %v", err))
+		return s.errorResponse(c, err)
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	s.logger.Log("USER", fmt.Sprintf("Watcher connected after event %d", after))
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() == nil {
+					s.logger.Log("USER", "Dropping slow watcher")
+					fmt.Fprint(w, "event: reset\ndata: too far behind, reconnect with Last-Event-ID\n\n")
+					w.Flush()
+				}
+				return nil
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// exportContentTypes maps dataset formats to response content types
+var exportContentTypes = map[string]string{
+	FormatJSON:   echo.MIMEApplicationJSON,
+	FormatNDJSON: "application/x-ndjson",
+	FormatCSV:    "text/csv",
+}
+
+// ExportUsersHandler streams the whole dataset as ?format=json|ndjson|csv
+func (s *UserService) ExportUsersHandler(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return c.String(http.StatusBadRequest, "Invalid format: expected json, ndjson or csv")
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, contentType)
+	w.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=users.%s", format))
+	w.WriteHeader(http.StatusOK)
+
+	// Too late to change the status once streaming has started
+	count, err := ExportUsers(c.Request().Context(), s.db, w, format)
+	if err != nil {
+		s.logger.Log("USER", fmt.Sprintf("Export failed after %d users: %v", count, err))
+		return nil
+	}
+	s.logger.Log("USER", fmt.Sprintf("Exported %d users as %s", count, format))
+	return nil
+}
+
+// ImportUsersHandler loads a dataset from the request body
+// Parameters: format (json, ndjson or csv), conflict (skip, overwrite or
+// fail) and dry_run. The response reports what was, or would be, imported;
+// if the import stops early, it still reports the records written before
+// that, with the status of the error that stopped it.
+func (s *UserService) ImportUsersHandler(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	opts := ImportOptions{
+		Format:   format,
+		Conflict: c.QueryParam("conflict"),
+		DryRun:   c.QueryParam("dry_run") == "true",
+	}
+
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, s.maxImport)
+	result, err := ImportUsers(c.Request().Context(), s.db, body, opts)
+	if err == nil {
+		s.logger.Log("USER", fmt.Sprintf("Import (dry run: %t): %d created, %d updated, %d skipped, %d errors",
+			result.DryRun, result.Created, result.Updated, result.Skipped, len(result.Errors)))
+		return c.JSON(http.StatusOK, result)
+	}
+	if result == nil {
+		// Rejected before reading anything
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	s.logger.Log("USER", fmt.Sprintf("Import stopped after %d created, %d updated: %v", result.Created, result.Updated, err))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, result)
+	case errors.Is(err, ErrInvalidDataset):
+		return c.JSON(http.StatusBadRequest, result)
+	case errors.Is(err, ErrImportConflict):
+		return c.JSON(http.StatusConflict, result)
+	default:
+		status, _ := errorStatus(err)
+		return c.JSON(status, result)
+	}
+}
+
+// errorResponse maps database errors to HTTP status codes
+func (s *UserService) errorResponse(c echo.Context, err error) error {
+	return c.String(errorStatus(err))
+}
+
+// errorStatus returns the HTTP status and message for a database error
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound, "User not found"
+	case errors.Is(err, ErrUserExists):
+		return http.StatusConflict, "User already exists"
+	case errors.Is(err, ErrVersionConflict):
+		return http.StatusPreconditionFailed, "User has changed, reload and retry"
+	case errors.Is(err, ErrInvalidQuery), errors.Is(err, ErrInvalidCursor):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, ErrNoTenant):
+		return http.StatusBadRequest, "Tenant required"
+	case errors.Is(err, ErrUnknownTenant):
+		return http.StatusNotFound, "Unknown tenant"
+	case errors.Is(err, ErrAuditDisabled):
+		return http.StatusNotFound, "Audit log not enabled"
+	case errors.Is(err, ErrReadOnly):
+		return http.StatusForbidden, "Database is read-only"
+	case errors.Is(err, ErrPoolExhausted):
+		return http.StatusServiceUnavailable, "Database busy"
+	case errors.Is(err, ErrCircuitOpen):
+		return http.StatusServiceUnavailable, "Database unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "Database timeout"
+	default:
+		return http.StatusInternalServerError, "Internal server error"
+	}
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/frrist/demofx/shared"
 )
@@ -33,29 +39,37 @@ func main() {
 	logger.Log("APP", "Created metrics collector")
 
 	// Step 4: Create database - NOW needs logger, config, AND metrics!
-	// BREAKING CHANGE: Had to update constructor call
-	// MORE COMPLEXITY: Now we need conditional logic for database type!
+	// MULTI-TENANCY: every tenant needs the whole stack, so the wiring had to
+	// move into a function we can hand over and call once per tenant
 	var db shared.Database
-	switch config.Database.Type {
-	case "persistent":
-		logger.Log("APP", "Creating persistent database")
-		db = shared.NewPersistentDatabase(logger, config, metrics)
-	default:
-		logger.Log("APP", "Creating in-memory database")
-		db = shared.NewInMemoryDatabase(logger, config, metrics)
+	if config.Tenancy.Enabled {
+		logger.Log("APP", "Creating multi-tenant database")
+		db = shared.NewTenantDatabase(func(config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
+			return newDatabase(logger, config, metrics)
+		}, logger, config, metrics)
+	} else {
+		db, err = newDatabase(logger, config, metrics)
+		if err != nil {
+			log.Fatal("Failed to create database:", err)
+		}
 	}
 
 	// Manual initialization
-	if err := db.Initialize(); err != nil {
+	if err := db.Initialize(context.Background()); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// Manual cleanup - easy to forget!
-	defer func() {
-		if err := db.Close(); err != nil {
-			log.Printf("Failed to close database: %v", err)
+	// Admin subcommands (export/import) - and we must remember to close the database ourselves
+	if len(os.Args) > 1 {
+		err := shared.RunCommand(context.Background(), db, os.Args[1:], os.Stdout)
+		if closeErr := db.Close(context.Background()); err == nil {
+			err = closeErr
 		}
-	}()
+		if err != nil {
+			log.Fatal("Command failed:", err)
+		}
+		return
+	}
 
 	// Step 5: Create user service - NOW needs db, logger, config, AND metrics!
 	// BREAKING CHANGE: Had to update constructor call
@@ -72,8 +86,80 @@ func main() {
 	logger.Log("APP", "Config: curl http://"+config.Server.Host+":"+config.Server.Port+"/config")
 	logger.Log("APP", "Metrics: curl http://"+config.Server.Host+":"+config.Server.Port+"/metrics")
 
-	// Server runs forever (blocking)
-	if err := server.Start(); err != nil {
-		log.Fatal("Server failed to start:", err)
+	// Server runs until a signal arrives - and we have to catch it ourselves,
+	// because log.Fatal and an unhandled SIGTERM both skip deferred cleanup
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+
+	select {
+	case sig := <-stop:
+		logger.Log("APP", "Received "+sig.String()+", shutting down")
+	case err := <-serverErr:
+		logger.Log("APP", "Server failed: "+err.Error())
+	}
+
+	// Manual cleanup, in the right order - easy to get wrong!
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		logger.Log("APP", "Failed to stop server: "+err.Error())
+	}
+	if err := db.Close(ctx); err != nil {
+		log.Fatal("Failed to close database:", err)
 	}
 }
+
+// newDatabase builds the database stack by hand
+// BREAKING CHANGE: Had to update constructor calls to pass metrics
+// MORE COMPLEXITY: Now we need conditional logic for database type!
+func newDatabase(logger *shared.Logger, config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
+	var db shared.Database
+	var err error
+	switch config.Database.Type {
+	case "persistent":
+		logger.Log("APP", "Creating persistent database")
+		db = shared.NewPersistentDatabase(logger, config, metrics)
+	case "replicated":
+		// YET ANOTHER error path to handle by hand
+		logger.Log("APP", "Creating replicated database")
+		db, err = shared.NewReplicatedDatabase(logger, config, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create replicated database: %w", err)
+		}
+	case "sharded":
+		logger.Log("APP", "Creating sharded database")
+		db, err = shared.NewShardedDatabase(logger, config, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sharded database: %w", err)
+		}
+	default:
+		logger.Log("APP", "Creating in-memory database")
+		db = shared.NewInMemoryDatabase(logger, config, metrics)
+	}
+
+	// MORE WIRING: Wrap the backend in a connection pool by hand
+	db = shared.NewPooledDatabase(db, logger, config, metrics)
+
+	// EVEN MORE WIRING: Build the middleware chain and handle its errors here too
+	middlewares, err := shared.NewMiddlewares(logger, config, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build database middleware: %w", err)
+	}
+	db = shared.Chain(db, middlewares...)
+
+	// AND wrap it in a cache, again by hand, checking the feature flag ourselves
+	if config.App.Features["cache_enabled"] {
+		db = shared.NewCachingDatabase(db, logger, config, metrics)
+	}
+
+	// AND the audit log - outermost, so its before-reads hit the cache
+	if config.App.Features["audit_log"] {
+		db = shared.NewAuditingDatabase(db, logger, config, metrics)
+	}
+
+	return db, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -51,7 +55,7 @@ func TestUserServiceTraditional(t *testing.T) {
 	mockDB := shared.NewMockDatabase()
 
 	// MANUAL SETUP: Initialize mock (easy to forget!)
-	err := mockDB.Initialize()
+	err := mockDB.Initialize(context.Background())
 	require.NoError(t, err)
 
 	// MANUAL SETUP: Create user service with all dependencies
@@ -72,7 +76,7 @@ func TestUserServiceTraditional(t *testing.T) {
 		// Assert
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
-		assert.Contains(t, rec.Body.String(), "Test User 1")
+		assert.Equal(t, "User: Test User 1\n", rec.Body.String())
 		assert.Equal(t, "test1", mockDB.LastRequestedID)
 		assert.Equal(t, 1, mockDB.GetUserCalls)
 	})
@@ -113,7 +117,7 @@ func TestUserServiceTraditional(t *testing.T) {
 	})
 
 	// MANUAL CLEANUP: Don't forget to close!
-	err = mockDB.Close()
+	err = mockDB.Close(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, 1, mockDB.CloseCalls)
 }
@@ -170,7 +174,7 @@ func TestDatabaseSwappingTraditional(t *testing.T) {
 			db := tc.setup()
 
 			// MANUAL: Initialize
-			err := db.Initialize()
+			err := db.Initialize(context.Background())
 			require.NoError(t, err)
 
 			// MANUAL: Create service with database
@@ -186,7 +190,7 @@ func TestDatabaseSwappingTraditional(t *testing.T) {
 			assert.NoError(t, err)
 
 			// MANUAL: Cleanup
-			err = db.Close()
+			err = db.Close(context.Background())
 			assert.NoError(t, err)
 		})
 	}
@@ -195,7 +199,7 @@ func TestDatabaseSwappingTraditional(t *testing.T) {
 // TestIntegrationSetupTraditional shows the pain of integration testing
 func TestIntegrationSetupTraditional(t *testing.T) {
 	// PROBLEM: To test the server, we need to wire EVERYTHING manually!
-	
+
 	config := &shared.Config{
 		Server:   shared.ServerConfig{Host: "localhost", Port: "0"}, // Use port 0 for testing
 		Database: shared.DatabaseConfig{Type: "mock"},
@@ -208,19 +212,378 @@ func TestIntegrationSetupTraditional(t *testing.T) {
 	logger := shared.NewLogger(config)
 	metrics := shared.NewMetrics(config)
 	mockDB := shared.NewMockDatabase()
-	
+
 	// Initialize everything manually
-	err := mockDB.Initialize()
+	err := mockDB.Initialize(context.Background())
 	require.NoError(t, err)
-	defer mockDB.Close()
+	defer mockDB.Close(context.Background())
 
 	userService := shared.NewUserService(mockDB, logger, config, metrics)
 	server := shared.NewServer(userService, logger, config, metrics)
 
 	// Can't easily test the server without starting it!
 	// This shows how traditional approach makes integration testing harder
-	
+
 	// Just verify we can create everything
 	assert.NotNil(t, server)
 	assert.Equal(t, 1, mockDB.InitializeCalls)
-}
\ No newline at end of file
+}
+
+// TestUserCRUDTraditional exercises the write endpoints against a cached in-memory database
+func TestUserCRUDTraditional(t *testing.T) {
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{Type: "inmemory", CacheSize: 10},
+		App: shared.AppConfig{
+			Environment: "test",
+			Features:    map[string]bool{"cache_enabled": true},
+		},
+	}
+
+	// MANUAL SETUP: Wire everything by hand again
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	db := shared.NewCachingDatabase(shared.NewInMemoryDatabase(logger, config, metrics), logger, config, metrics)
+	require.NoError(t, db.Initialize(context.Background()))
+	defer db.Close(context.Background())
+
+	userService := shared.NewUserService(db, logger, config, metrics)
+	server := shared.NewServer(userService, logger, config, metrics)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/users", `{"id":"42","name":"Zaphod"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = do(http.MethodPost, "/users", `{"id":"42","name":"Zaphod"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// Prime the cache, then make sure an update is visible
+	rec = do(http.MethodGet, "/user?id=42", "")
+	assert.Equal(t, "User: Zaphod\n", rec.Body.String())
+
+	rec = do(http.MethodPut, "/users/42", `{"name":"Arthur"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/user?id=42", "")
+	assert.Equal(t, "User: Arthur\n", rec.Body.String())
+
+	// The full record is served to clients that ask for JSON
+	req := httptest.NewRequest(http.MethodGet, "/user?id=42", nil)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"Arthur"`)
+
+	rec = do(http.MethodGet, "/users", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"Arthur"`)
+
+	// Batch lookup reports each ID, including the missing ones
+	rec = do(http.MethodGet, "/users?ids=42,1,nope", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"Arthur"`)
+	assert.Contains(t, rec.Body.String(), `"name":"Alice"`)
+	assert.Contains(t, rec.Body.String(), `{"id":"nope","error":"user not found"}`)
+
+	// Paged search hands out an opaque cursor and rejects forged ones
+	rec = do(http.MethodGet, "/users?prefix=a&sort=name&limit=1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"Alice"`)
+	assert.Contains(t, rec.Body.String(), `"next_cursor":`)
+
+	rec = do(http.MethodGet, "/users?limit=1&cursor=forged", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(http.MethodDelete, "/users/42", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = do(http.MethodDelete, "/users/42", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestConditionalRequestsTraditional checks ETags and If-Match/If-None-Match
+func TestConditionalRequestsTraditional(t *testing.T) {
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{Type: "inmemory"},
+		App:      shared.AppConfig{Environment: "test"},
+	}
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	db := shared.NewInMemoryDatabase(logger, config, metrics)
+	require.NoError(t, db.Initialize(context.Background()))
+	defer db.Close(context.Background())
+	server := shared.NewServer(shared.NewUserService(db, logger, config, metrics), logger, config, metrics)
+
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/user?id=1", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.Regexp(t, `^"1-[0-9a-z]+"$`, etag)
+
+	rec = do(http.MethodGet, "/user?id=1", "", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// The first writer wins; the second still holds the old ETag
+	rec = do(http.MethodPut, "/users/1", `{"name":"Alicia"}`, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	etag2 := rec.Header().Get("ETag")
+	assert.Regexp(t, `^"2-[0-9a-z]+"$`, etag2)
+
+	rec = do(http.MethodPut, "/users/1", `{"name":"Alison"}`, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = do(http.MethodPut, "/users/1", `{"name":"Alison"}`, map[string]string{"If-Match": etag + ", " + etag2})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/user?id=1", "", map[string]string{"If-None-Match": etag, "Accept": "application/json"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"Alison"`)
+	assert.Contains(t, rec.Body.String(), `"version":3`)
+
+	// A user deleted and created again starts over at version 1, but a tag
+	// for the old record must not match the new one
+	rec = do(http.MethodPost, "/users", `{"id":"7","name":"George"}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	old := rec.Header().Get("ETag")
+	rec = do(http.MethodDelete, "/users/7", "", nil)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = do(http.MethodPost, "/users", `{"id":"7","name":"Georgia"}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.NotEqual(t, old, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPut, "/users/7", `{"name":"Gina"}`, map[string]string{"If-Match": old})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodGet, "/user?id=7", "", map[string]string{"If-None-Match": old})
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// TestConnectionPoolTraditional shows queries being rejected once max_connections are busy
+func TestConnectionPoolTraditional(t *testing.T) {
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{
+			Type:            "inmemory",
+			MaxConnections:  1,
+			PoolWaitTimeout: 10,
+		},
+		App: shared.AppConfig{
+			Environment: "test",
+			Features:    map[string]bool{"metrics_enabled": true},
+		},
+	}
+
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	db := shared.NewPooledDatabase(shared.NewInMemoryDatabase(logger, config, metrics), logger, config, metrics)
+
+	// Hold the only connection with a slow lookup
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.GetUser(context.Background(), "1")
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		return strings.Contains(metrics.GetStats(), "In Use: 1/1")
+	}, time.Second, time.Millisecond)
+
+	_, err := db.GetUser(context.Background(), "2")
+	assert.ErrorIs(t, err, shared.ErrPoolExhausted)
+	assert.NoError(t, <-done)
+
+	stats := metrics.GetStats()
+	assert.Contains(t, stats, "In Use: 0/1")
+	assert.Contains(t, stats, "Rejections: 1")
+}
+
+// TestUserEventsTraditional streams changes over Server-Sent Events
+func TestUserEventsTraditional(t *testing.T) {
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{Type: "inmemory"},
+		App:      shared.AppConfig{Environment: "test"},
+	}
+
+	// MANUAL SETUP: One more hand-wired stack, this time behind a real listener
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	db := shared.NewInMemoryDatabase(logger, config, metrics)
+	userService := shared.NewUserService(db, logger, config, metrics)
+	server := httptest.NewServer(shared.NewServer(userService, logger, config, metrics))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/users/events", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	_, err = db.CreateUser(ctx, shared.NewUser("42", "Zaphod"))
+	require.NoError(t, err)
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "id: 1", lines[0])
+	assert.Equal(t, "event: create", lines[1])
+	assert.Contains(t, lines[2], `"name":"Zaphod"`)
+
+	// IDs the server never issued can't be resumed from
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/users/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "99")
+	gone, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	gone.Body.Close()
+	assert.Equal(t, http.StatusGone, gone.StatusCode)
+}
+
+// TestAdminTransferTraditional exports and imports datasets over the admin API
+func TestAdminTransferTraditional(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{Type: "inmemory"},
+		App: shared.AppConfig{
+			Environment:    "test",
+			Features:       map[string]bool{"admin_api": true},
+			MaxImportBytes: 256,
+		},
+	}
+
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	db := shared.NewInMemoryDatabase(logger, config, metrics)
+	userService := shared.NewUserService(db, logger, config, metrics)
+	server := shared.NewServer(userService, logger, config, metrics)
+
+	admin := func(method, target, body string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Callers must present the token
+	assert.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/export", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/export", "", "guess").Code)
+
+	rec := admin(http.MethodGet, "/admin/export?format=csv", "", "s3cret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get(echo.HeaderContentType))
+	assert.Contains(t, rec.Body.String(), "1,Alice,")
+
+	body := `{"id":"1","name":"Alice"}` + "\n" + `{"id":"7","name":"George"}` + "\n"
+	rec = admin(http.MethodPost, "/admin/import?format=ndjson&conflict=fail", body, "s3cret")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error":`)
+
+	rec = admin(http.MethodPost, "/admin/import?format=ndjson", body, "s3cret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"created":1`)
+	assert.Contains(t, rec.Body.String(), `"skipped":1`)
+
+	// Bodies over max_import_bytes are cut off, and the report says so
+	rec = admin(http.MethodPost, "/admin/import?format=ndjson", strings.Repeat(body, 10), "s3cret")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "request body too large")
+
+	// Without a token the admin API stays off even with the feature flag
+	t.Setenv("ADMIN_TOKEN", "")
+	server = shared.NewServer(userService, logger, config, metrics)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodGet, "/admin/export", "", "").Code)
+
+	// Without the feature flag the admin API doesn't exist
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	config.App.Features["admin_api"] = false
+	server = shared.NewServer(userService, logger, config, metrics)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodGet, "/admin/export", "", "s3cret").Code)
+}
+
+// TestTenantsTraditional routes requests to per-tenant stores by header or subdomain
+func TestTenantsTraditional(t *testing.T) {
+	config := &shared.Config{
+		Database: shared.DatabaseConfig{Type: "inmemory", StartEmpty: true},
+		Tenancy: shared.TenancyConfig{
+			Enabled: true,
+			Domain:  "users.example.com",
+			Tenants: []string{"acme", "globex"},
+		},
+		App: shared.AppConfig{
+			Environment: "test",
+			Features:    map[string]bool{"metrics_enabled": true},
+		},
+	}
+
+	logger := shared.NewLogger(config)
+	metrics := shared.NewMetrics(config)
+	// The whole stack is built again for every tenant
+	db := shared.NewTenantDatabase(func(config *shared.Config, metrics *shared.Metrics) (shared.Database, error) {
+		return newDatabase(logger, config, metrics)
+	}, logger, config, metrics)
+	require.NoError(t, db.Initialize(context.Background()))
+	defer db.Close(context.Background())
+	server := shared.NewServer(shared.NewUserService(db, logger, config, metrics), logger, config, metrics)
+
+	do := func(method, target, host, tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Host = host
+		if tenant != "" {
+			req.Header.Set(shared.DefaultTenantHeader, tenant)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/users", "localhost", "acme", `{"id":"1","name":"Acme One"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = do(http.MethodGet, "/user?id=1", "acme.users.example.com:8080", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "User: Acme One\n", rec.Body.String())
+
+	rec = do(http.MethodGet, "/user?id=1", "globex.users.example.com", "", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(http.MethodGet, "/user?id=1", "localhost", "", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(http.MethodGet, "/user?id=1", "localhost", "initech", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Endpoints without user data don't need a tenant
+	rec = do(http.MethodGet, "/health", "localhost", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/metrics", "localhost", "acme", "")
+	assert.Contains(t, rec.Body.String(), "Metrics for Tenant acme")
+	assert.Contains(t, rec.Body.String(), "/users: 1 requests")
+	rec = do(http.MethodGet, "/metrics", "localhost", "", "")
+	assert.Contains(t, rec.Body.String(), "/user: 4 requests")
+	assert.NotContains(t, rec.Body.String(), "acme")
+	assert.Contains(t, metrics.TenantStats(), "  acme: 2 requests")
+}